@@ -0,0 +1,496 @@
+package main
+
+import (
+	"math/bits"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ChairSearchQuery /api/chair/search の検索条件
+type ChairSearchQuery struct {
+	Price    *Range
+	Height   *Range
+	Width    *Range
+	Depth    *Range
+	Kind     string
+	Color    string
+	Features FeatureFilter
+
+	// PriceBound などは priceMin, priceMax のような自由な範囲の指定で、Price などと組み合わせて絞り込む
+	PriceBound  *Range
+	HeightBound *Range
+	WidthBound  *Range
+	DepthBound  *Range
+
+	Text *textQuery
+}
+
+// parseChairSearchQuery クエリパラメータから検索条件を作る。保存された検索条件の照合にも使う
+func parseChairSearchQuery(params url.Values) (*ChairSearchQuery, error) {
+	q := &ChairSearchQuery{}
+	var err error
+	if q.Price, err = parseRangeParam(params, "priceRangeId", chairSearchCondition.Price); err != nil {
+		return nil, err
+	}
+	if q.Height, err = parseRangeParam(params, "heightRangeId", chairSearchCondition.Height); err != nil {
+		return nil, err
+	}
+	if q.Width, err = parseRangeParam(params, "widthRangeId", chairSearchCondition.Width); err != nil {
+		return nil, err
+	}
+	if q.Depth, err = parseRangeParam(params, "depthRangeId", chairSearchCondition.Depth); err != nil {
+		return nil, err
+	}
+	if q.Kind, err = parseListParam(params, "kind", chairSearchCondition.Kind); err != nil {
+		return nil, err
+	}
+	if q.Color, err = parseListParam(params, "color", chairSearchCondition.Color); err != nil {
+		return nil, err
+	}
+	if q.Features, err = parseFeatureFilter(chairFeatureTags, params); err != nil {
+		return nil, err
+	}
+	if q.PriceBound, err = parseBoundParams(params, "price", searchMaxPrice); err != nil {
+		return nil, err
+	}
+	if q.HeightBound, err = parseBoundParams(params, "height", searchMaxSize); err != nil {
+		return nil, err
+	}
+	if q.WidthBound, err = parseBoundParams(params, "width", searchMaxSize); err != nil {
+		return nil, err
+	}
+	if q.DepthBound, err = parseBoundParams(params, "depth", searchMaxSize); err != nil {
+		return nil, err
+	}
+	if q.Text, err = parseTextQuery(params.Get("q")); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *ChairSearchQuery) isEmpty() bool {
+	return q.Price == nil && q.Height == nil && q.Width == nil && q.Depth == nil &&
+		q.Kind == "" && q.Color == "" && q.Features.isEmpty() &&
+		q.PriceBound == nil && q.HeightBound == nil && q.WidthBound == nil && q.DepthBound == nil &&
+		q.Text == nil
+}
+
+func (q *ChairSearchQuery) hasText() bool {
+	return q.Text != nil
+}
+
+func (q *ChairSearchQuery) match(chair *Chair) bool {
+	if !inRange(q.Price, chair.Price) || !inRange(q.Height, chair.Height) ||
+		!inRange(q.Width, chair.Width) || !inRange(q.Depth, chair.Depth) {
+		return false
+	}
+	if !inRange(q.PriceBound, chair.Price) || !inRange(q.HeightBound, chair.Height) ||
+		!inRange(q.WidthBound, chair.Width) || !inRange(q.DepthBound, chair.Depth) {
+		return false
+	}
+	if q.Kind != "" && chair.Kind != q.Kind {
+		return false
+	}
+	if q.Color != "" && chair.Color != q.Color {
+		return false
+	}
+	if q.Text != nil && !q.Text.match(chair.ID) {
+		return false
+	}
+	return q.Features.match(chair.FeatureMask)
+}
+
+// inRange r が nil の場合は条件なしとして扱う
+func inRange(r *Range, v int64) bool {
+	if r == nil {
+		return true
+	}
+	if r.Min != -1 && v < r.Min {
+		return false
+	}
+	if r.Max != -1 && v >= r.Max {
+		return false
+	}
+	return true
+}
+
+// findRange v が含まれる Range を返す
+func findRange(cond RangeCondition, v int64) *Range {
+	for _, r := range cond.Ranges {
+		if inRange(r, v) {
+			return r
+		}
+	}
+	return nil
+}
+
+// chairList popularity_m, id の昇順に並んだ椅子の列
+type chairList []*Chair
+
+func chairLess(a, b *Chair) bool {
+	if a.PopularityM != b.PopularityM {
+		return a.PopularityM < b.PopularityM
+	}
+	return a.ID < b.ID
+}
+
+func (l chairList) search(chair *Chair) int {
+	return sort.Search(len(l), func(i int) bool { return !chairLess(l[i], chair) })
+}
+
+func (l chairList) insert(chair *Chair) chairList {
+	i := l.search(chair)
+	l = append(l, nil)
+	copy(l[i+1:], l[i:])
+	l[i] = chair
+	return l
+}
+
+func (l chairList) remove(chair *Chair) chairList {
+	i := l.search(chair)
+	if i < len(l) && l[i] == chair {
+		l = append(l[:i], l[i+1:]...)
+	}
+	return l
+}
+
+// chairIndex 在庫のある椅子をメモリ上に保持する検索用インデックス
+type chairIndex struct {
+	mu sync.RWMutex
+
+	byID map[int64]*Chair
+	all  chairList
+
+	price   map[int64]chairList
+	height  map[int64]chairList
+	width   map[int64]chairList
+	depth   map[int64]chairList
+	kind    map[string]chairList
+	color   map[string]chairList
+	feature map[uint64]chairList
+	// footprint 扉を通るかの判定に使う断面ごとの列
+	footprint map[chairFootprint]chairList
+}
+
+func newChairIndex() *chairIndex {
+	return &chairIndex{
+		byID:    map[int64]*Chair{},
+		price:   map[int64]chairList{},
+		height:  map[int64]chairList{},
+		width:   map[int64]chairList{},
+		depth:   map[int64]chairList{},
+		kind:    map[string]chairList{},
+		color:   map[string]chairList{},
+		feature: map[uint64]chairList{},
+
+		footprint: map[chairFootprint]chairList{},
+	}
+}
+
+var chairSearchIndex = newChairIndex()
+
+// Load chair テーブルから在庫のある椅子を読み込んでインデックスを作り直す
+func (idx *chairIndex) Load(db *sqlx.DB) error {
+	var chairs []Chair
+	if err := db.Select(&chairs, "SELECT * FROM chair WHERE `in_stock` = 1 ORDER BY popularity_m ASC, id ASC"); err != nil {
+		return err
+	}
+
+	fresh := newChairIndex()
+	for i := range chairs {
+		fresh.add(&chairs[i])
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.byID = fresh.byID
+	idx.all = fresh.all
+	idx.price = fresh.price
+	idx.height = fresh.height
+	idx.width = fresh.width
+	idx.depth = fresh.depth
+	idx.kind = fresh.kind
+	idx.color = fresh.color
+	idx.feature = fresh.feature
+	idx.footprint = fresh.footprint
+	return nil
+}
+
+// Add 新しく登録された椅子をインデックスに追加する
+func (idx *chairIndex) Add(chairs []Chair) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for i := range chairs {
+		chair := chairs[i]
+		chair.PopularityM = -chair.Popularity
+		chair.InStock = chair.Stock > 0
+		if old, ok := idx.byID[chair.ID]; ok {
+			idx.remove(old)
+		}
+		if chair.InStock {
+			idx.add(&chair)
+		}
+	}
+}
+
+// Listed 椅子が在庫ありとして検索対象に入っているかを返す
+func (idx *chairIndex) Listed(id int64) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	_, ok := idx.byID[id]
+	return ok
+}
+
+// SetStock 椅子の在庫数を更新し、在庫がなくなった椅子は検索対象から外す
+func (idx *chairIndex) SetStock(id int64, stock int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	chair, ok := idx.byID[id]
+	if !ok {
+		return
+	}
+	if stock <= 0 {
+		idx.remove(chair)
+		return
+	}
+	chair.Stock = stock
+}
+
+// Search 条件に一致する椅子の総数と、p の並び順で offset から limit 件の椅子を返す。
+// cursor が指定された場合は offset の代わりに cursor より後ろの椅子を返す。
+// more は返した椅子より後ろに条件に一致する椅子が残っているかを表す
+func (idx *chairIndex) Search(q *ChairSearchQuery, p searchPage[Chair]) (count int64, chairs []Chair, more bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.page(idx.candidates(q), q.match, q, p)
+}
+
+// Fitting door を通る椅子のうち q に一致するものを Search と同じ形で返す
+func (idx *chairIndex) Fitting(door doorSize, q *ChairSearchQuery, p searchPage[Chair]) (count int64, chairs []Chair, more bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// 断面の種類は椅子の数よりずっと少ないので、断面ごとに判定しておく
+	fits := map[chairFootprint]bool{}
+	lists := make([]chairList, 0)
+	n := 0
+	for fp, l := range idx.footprint {
+		if fp.fits(door) {
+			fits[fp] = true
+			lists = append(lists, l)
+			n += len(l)
+		}
+	}
+
+	candidates := idx.candidates(q)
+	if n < len(candidates) {
+		candidates = mergeChairLists(lists, n)
+	}
+	match := func(chair *Chair) bool {
+		return fits[footprintOf(chair)] && q.match(chair)
+	}
+	return idx.page(candidates, match, q, p)
+}
+
+// page candidates のうち match が true を返す椅子を p の並び順に並べ、p の指す範囲を返す
+func (idx *chairIndex) page(candidates chairList, match func(*Chair) bool, q *ChairSearchQuery, p searchPage[Chair]) (count int64, chairs []Chair, more bool) {
+	matched := make([]*Chair, 0)
+	for _, chair := range candidates {
+		if match(chair) {
+			matched = append(matched, chair)
+		}
+	}
+	// 各列は人気順に並んでいるので、それ以外の並び順のときだけ並べ替える
+	switch {
+	case p.Order.relevance:
+		scores := q.Text.scores
+		sort.SliceStable(matched, func(i, j int) bool { return scores[matched[i].ID] > scores[matched[j].ID] })
+	case !p.Order.isDefault():
+		sort.Slice(matched, func(i, j int) bool { return p.Order.less(matched[i], matched[j]) })
+	}
+
+	start := p.offset()
+	if p.Cursor != nil {
+		start = sort.Search(len(matched), func(i int) bool { return p.Order.after(p.Cursor, matched[i]) })
+	}
+	chairs = []Chair{}
+	for i := start; i < len(matched) && len(chairs) < p.PerPage; i++ {
+		chairs = append(chairs, *matched[i])
+	}
+	return int64(len(matched)), chairs, start+len(chairs) < len(matched)
+}
+
+// LowPriced 価格の安い順に limit 件の椅子を返す
+func (idx *chairIndex) LowPriced(limit int) []Chair {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	lowest := make([]*Chair, 0, limit+1)
+	for _, chair := range idx.all {
+		i := sort.Search(len(lowest), func(i int) bool {
+			if lowest[i].Price != chair.Price {
+				return lowest[i].Price > chair.Price
+			}
+			return lowest[i].ID > chair.ID
+		})
+		if i >= limit {
+			continue
+		}
+		lowest = append(lowest, nil)
+		copy(lowest[i+1:], lowest[i:])
+		lowest[i] = chair
+		if len(lowest) > limit {
+			lowest = lowest[:limit]
+		}
+	}
+
+	chairs := make([]Chair, 0, len(lowest))
+	for _, chair := range lowest {
+		chairs = append(chairs, *chair)
+	}
+	return chairs
+}
+
+// candidates 条件に対応する列のうち最も短いものを返す。
+// 自由な範囲の指定は、範囲と重なる区分の列をまとめたものを1つの候補にする
+func (idx *chairIndex) candidates(q *ChairSearchQuery) chairList {
+	lists := make([][]chairList, 0, 4+2+bits.OnesCount64(q.Features.All)+4)
+	if q.Price != nil {
+		lists = append(lists, []chairList{idx.price[q.Price.ID]})
+	}
+	if q.Height != nil {
+		lists = append(lists, []chairList{idx.height[q.Height.ID]})
+	}
+	if q.Width != nil {
+		lists = append(lists, []chairList{idx.width[q.Width.ID]})
+	}
+	if q.Depth != nil {
+		lists = append(lists, []chairList{idx.depth[q.Depth.ID]})
+	}
+	if q.Kind != "" {
+		lists = append(lists, []chairList{idx.kind[q.Kind]})
+	}
+	if q.Color != "" {
+		lists = append(lists, []chairList{idx.color[q.Color]})
+	}
+	for _, bit := range maskBits(q.Features.All) {
+		lists = append(lists, []chairList{idx.feature[bit]})
+	}
+	if q.PriceBound != nil {
+		lists = append(lists, overlappingLists(idx.price, chairSearchCondition.Price, q.PriceBound))
+	}
+	if q.HeightBound != nil {
+		lists = append(lists, overlappingLists(idx.height, chairSearchCondition.Height, q.HeightBound))
+	}
+	if q.WidthBound != nil {
+		lists = append(lists, overlappingLists(idx.width, chairSearchCondition.Width, q.WidthBound))
+	}
+	if q.DepthBound != nil {
+		lists = append(lists, overlappingLists(idx.depth, chairSearchCondition.Depth, q.DepthBound))
+	}
+	if q.Text != nil && q.Text.scores != nil {
+		lists = append(lists, []chairList{idx.textMatches(q.Text)})
+	}
+
+	shortest := []chairList{idx.all}
+	shortestLen := len(idx.all)
+	for _, ls := range lists {
+		n := 0
+		for _, l := range ls {
+			n += len(l)
+		}
+		if n < shortestLen {
+			shortest, shortestLen = ls, n
+		}
+	}
+	if len(shortest) == 1 {
+		return shortest[0]
+	}
+
+	return mergeChairLists(shortest, shortestLen)
+}
+
+// mergeChairLists 重なりのない列をまとめて popularity_m, id の順に並べる
+func mergeChairLists(ls []chairList, n int) chairList {
+	merged := make(chairList, 0, n)
+	for _, l := range ls {
+		merged = append(merged, l...)
+	}
+	sort.Slice(merged, func(i, j int) bool { return chairLess(merged[i], merged[j]) })
+	return merged
+}
+
+// textMatches FULLTEXT インデックスで一致した椅子のうち在庫のあるものを popularity_m, id の順に並べる
+func (idx *chairIndex) textMatches(t *textQuery) chairList {
+	l := make(chairList, 0, len(t.scores))
+	for id := range t.scores {
+		if chair, ok := idx.byID[id]; ok {
+			l = append(l, chair)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return chairLess(l[i], l[j]) })
+	return l
+}
+
+// overlappingLists bound と重なる区分の列を返す
+func overlappingLists(lists map[int64]chairList, cond RangeCondition, bound *Range) []chairList {
+	ls := make([]chairList, 0, len(cond.Ranges))
+	for _, r := range cond.Ranges {
+		if overlaps(r, bound) {
+			ls = append(ls, lists[r.ID])
+		}
+	}
+	return ls
+}
+
+func (idx *chairIndex) add(chair *Chair) {
+	idx.byID[chair.ID] = chair
+	idx.all = idx.all.insert(chair)
+	if r := findRange(chairSearchCondition.Price, chair.Price); r != nil {
+		idx.price[r.ID] = idx.price[r.ID].insert(chair)
+	}
+	if r := findRange(chairSearchCondition.Height, chair.Height); r != nil {
+		idx.height[r.ID] = idx.height[r.ID].insert(chair)
+	}
+	if r := findRange(chairSearchCondition.Width, chair.Width); r != nil {
+		idx.width[r.ID] = idx.width[r.ID].insert(chair)
+	}
+	if r := findRange(chairSearchCondition.Depth, chair.Depth); r != nil {
+		idx.depth[r.ID] = idx.depth[r.ID].insert(chair)
+	}
+	idx.kind[chair.Kind] = idx.kind[chair.Kind].insert(chair)
+	idx.color[chair.Color] = idx.color[chair.Color].insert(chair)
+	for _, bit := range maskBits(chair.FeatureMask) {
+		idx.feature[bit] = idx.feature[bit].insert(chair)
+	}
+	fp := footprintOf(chair)
+	idx.footprint[fp] = idx.footprint[fp].insert(chair)
+}
+
+func (idx *chairIndex) remove(chair *Chair) {
+	delete(idx.byID, chair.ID)
+	idx.all = idx.all.remove(chair)
+	if r := findRange(chairSearchCondition.Price, chair.Price); r != nil {
+		idx.price[r.ID] = idx.price[r.ID].remove(chair)
+	}
+	if r := findRange(chairSearchCondition.Height, chair.Height); r != nil {
+		idx.height[r.ID] = idx.height[r.ID].remove(chair)
+	}
+	if r := findRange(chairSearchCondition.Width, chair.Width); r != nil {
+		idx.width[r.ID] = idx.width[r.ID].remove(chair)
+	}
+	if r := findRange(chairSearchCondition.Depth, chair.Depth); r != nil {
+		idx.depth[r.ID] = idx.depth[r.ID].remove(chair)
+	}
+	idx.kind[chair.Kind] = idx.kind[chair.Kind].remove(chair)
+	idx.color[chair.Color] = idx.color[chair.Color].remove(chair)
+	for _, bit := range maskBits(chair.FeatureMask) {
+		idx.feature[bit] = idx.feature[bit].remove(chair)
+	}
+	fp := footprintOf(chair)
+	idx.footprint[fp] = idx.footprint[fp].remove(chair)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// searchCursor 検索結果のページ位置。並び順の名前と、直前のページの最後の行の並び順のキーと id を持つ
+type searchCursor struct {
+	Sort string
+	Key  int64
+	ID   int64
+}
+
+// encode クライアントが中身に依存しないように不透明な文字列にする
+func (c searchCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%d", c.Sort, c.Key, c.ID)))
+}
+
+func decodeSearchCursor(s string) (*searchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %v", s)
+	}
+	parts := strings.Split(string(b), ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid cursor: %v", s)
+	}
+	c := searchCursor{Sort: parts[0]}
+	if c.Key, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %v", s)
+	}
+	if c.ID, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %v", s)
+	}
+	return &c, nil
+}
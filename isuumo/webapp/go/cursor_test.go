@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestSearchCursorRoundTrip(t *testing.T) {
+	tests := []searchCursor{
+		{Sort: "popularity", Key: -1500, ID: 12},
+		{Sort: "price_asc", Key: 0, ID: 1},
+		{Sort: "newest", Key: 30000, ID: 30000},
+		{Sort: "rent_desc", Key: 1 << 40, ID: 1 << 40},
+	}
+	for _, want := range tests {
+		s := want.encode()
+		got, err := decodeSearchCursor(s)
+		if err != nil {
+			t.Errorf("decodeSearchCursor(%q) error = %v", s, err)
+			continue
+		}
+		if *got != want {
+			t.Errorf("decodeSearchCursor(%q) = %+v, want %+v", s, *got, want)
+		}
+	}
+}
+
+func TestDecodeSearchCursorInvalid(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"empty", ""},
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("popularity:1:2"))},
+		{"too few parts", encode("popularity:1")},
+		{"too many parts", encode("popularity:1:2:3")},
+		{"key not a number", encode("popularity:x:2")},
+		{"id not a number", encode("popularity:1:y")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if c, err := decodeSearchCursor(tt.cursor); err == nil {
+				t.Errorf("decodeSearchCursor(%q) = %+v, want error", tt.cursor, *c)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// EstateDocumentRequest 物件の資料請求
+type EstateDocumentRequest struct {
+	ID             int64      `db:"id" json:"id"`
+	EstateID       int64      `db:"estate_id" json:"estateId"`
+	Email          string     `db:"email" json:"email"`
+	Message        string     `db:"message" json:"message"`
+	CreatedAt      time.Time  `db:"created_at" json:"createdAt"`
+	AcknowledgedAt *time.Time `db:"acknowledged_at" json:"acknowledgedAt"`
+}
+
+type EstateDocumentRequestListResponse struct {
+	Count    int64                   `json:"count"`
+	Requests []EstateDocumentRequest `json:"requests"`
+}
+
+// rateLimiter キーごとに window の間 limit 回までを許可する固定ウィンドウ方式のレートリミッタ
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: map[string]*rateWindow{},
+	}
+}
+
+// Allow key の今回のリクエストを許可してよいかを返す
+func (l *rateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		l.windows[key] = &rateWindow{start: now, count: 1}
+		return true
+	}
+	if w.count >= l.limit {
+		return false
+	}
+	w.count++
+	return true
+}
+
+// sweep 期限の切れたウィンドウを捨てる
+func (l *rateLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, w := range l.windows {
+		if now.Sub(w.start) >= l.window {
+			delete(l.windows, k)
+		}
+	}
+}
+
+// runSweeper 古いウィンドウが溜まり続けないように interval ごとに掃除する
+func (l *rateLimiter) runSweeper(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.sweep()
+	}
+}
+
+// documentRequestLimiter 1つのメールアドレスから送れる資料請求の数を制限する
+var documentRequestLimiter = newRateLimiter(10, time.Minute)
+
+// EstateDocumentRequestedEvent 資料請求を受け付けたときに outbox に記録するイベント
+type EstateDocumentRequestedEvent struct {
+	RequestID int64  `json:"requestId"`
+	EstateID  int64  `json:"estateId"`
+	Email     string `json:"email"`
+	Message   string `json:"message"`
+}
+
+// insertEstateDocumentRequest 資料請求を記録し、同じトランザクションで資料請求イベントを outbox に積む
+func insertEstateDocumentRequest(estateID int64, email string, message string) (int64, error) {
+	tx, err := estateDb.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO estate_document_request (estate_id, email, message) VALUES (?, ?, ?)", estateID, email, message)
+	if err != nil {
+		return 0, err
+	}
+	requestID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	event := EstateDocumentRequestedEvent{
+		RequestID: requestID,
+		EstateID:  estateID,
+		Email:     email,
+		Message:   message,
+	}
+	if err := enqueueOutboxEvent(tx, "estate.document_requested", event); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return requestID, nil
+}
+
+func getEstateDocumentRequests(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	page, perPage, err := parsePagination(c)
+	if err != nil {
+		c.Logger().Infof("Invalid format pagination parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	var res EstateDocumentRequestListResponse
+	if err := estateDb.Get(&res.Count, "SELECT COUNT(*) FROM estate_document_request WHERE estate_id = ?", id); err != nil {
+		c.Logger().Errorf("getEstateDocumentRequests DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res.Requests = []EstateDocumentRequest{}
+	query := "SELECT * FROM estate_document_request WHERE estate_id = ? ORDER BY id DESC LIMIT ? OFFSET ?"
+	if err := estateDb.Select(&res.Requests, query, id, perPage, page*perPage); err != nil {
+		c.Logger().Errorf("getEstateDocumentRequests DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func acknowledgeEstateDocumentRequest(c echo.Context) error {
+	rid, err := strconv.Atoi(c.Param("rid"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"rid\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	// 既に確認済みの場合は最初に確認した日時のままにする
+	if _, err := estateDb.Exec("UPDATE estate_document_request SET acknowledged_at = CURRENT_TIMESTAMP(6) WHERE id = ? AND acknowledged_at IS NULL", rid); err != nil {
+		c.Logger().Errorf("acknowledgeEstateDocumentRequest DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var req EstateDocumentRequest
+	if err := estateDb.Get(&req, "SELECT * FROM estate_document_request WHERE id = ?", rid); err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("document request id %v not found", rid)
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Logger().Errorf("acknowledgeEstateDocumentRequest DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, req)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type doorSize struct {
+	width  int64
+	height int64
+}
+
+// estateDoorIndex 物件を扉の大きさごとに分けて人気順に保持するおすすめ物件用インデックス。
+// 扉の大きさの種類は物件数よりずっと少ないので、大きさごとに通るかを判定して人気順の上位だけをまとめる
+type estateDoorIndex struct {
+	mu sync.RWMutex
+
+	byID  map[int64]*Estate
+	doors map[doorSize][]*Estate
+}
+
+func newEstateDoorIndex() *estateDoorIndex {
+	return &estateDoorIndex{
+		byID:  map[int64]*Estate{},
+		doors: map[doorSize][]*Estate{},
+	}
+}
+
+var estateRecommendIndex = newEstateDoorIndex()
+
+// Load estate テーブルから全物件を読み込んでインデックスを作り直す
+func (idx *estateDoorIndex) Load(db *sqlx.DB) error {
+	var estates []Estate
+	if err := db.Select(&estates, "SELECT * FROM estate"); err != nil {
+		return err
+	}
+
+	fresh := newEstateDoorIndex()
+	for i := range estates {
+		estate := &estates[i]
+		size := doorSize{width: estate.DoorWidth, height: estate.DoorHeight}
+		fresh.byID[estate.ID] = estate
+		fresh.doors[size] = append(fresh.doors[size], estate)
+	}
+	for _, estates := range fresh.doors {
+		sort.Slice(estates, func(i, j int) bool { return estateLess(estates[i], estates[j]) })
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.byID = fresh.byID
+	idx.doors = fresh.doors
+	return nil
+}
+
+// Add 新しく登録された物件をインデックスに追加し、追加または置き換えで結果が変わりうる扉の大きさを返す
+func (idx *estateDoorIndex) Add(estates []Estate) []doorSize {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	changed := map[doorSize]struct{}{}
+	for i := range estates {
+		estate := estates[i]
+		estate.PopularityM = -estate.Popularity
+		if old, ok := idx.byID[estate.ID]; ok {
+			changed[doorSize{width: old.DoorWidth, height: old.DoorHeight}] = struct{}{}
+			idx.remove(old)
+		}
+		changed[doorSize{width: estate.DoorWidth, height: estate.DoorHeight}] = struct{}{}
+		idx.insert(&estate)
+	}
+	doors := make([]doorSize, 0, len(changed))
+	for door := range changed {
+		doors = append(doors, door)
+	}
+	return doors
+}
+
+// Search fit が通る扉を持つ物件を人気順に最大 limit 件返す
+func (idx *estateDoorIndex) Search(fit chairFit, limit int) []Estate {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var candidates []*Estate
+	for size, estates := range idx.doors {
+		if !fit.passes(size.width, size.height) {
+			continue
+		}
+		if len(estates) > limit {
+			estates = estates[:limit]
+		}
+		candidates = append(candidates, estates...)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return estateLess(candidates[i], candidates[j]) })
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	res := make([]Estate, 0, len(candidates))
+	for _, estate := range candidates {
+		res = append(res, *estate)
+	}
+	return res
+}
+
+func (idx *estateDoorIndex) insert(estate *Estate) {
+	idx.byID[estate.ID] = estate
+	size := doorSize{width: estate.DoorWidth, height: estate.DoorHeight}
+	estates := idx.doors[size]
+	i := sort.Search(len(estates), func(i int) bool { return estateLess(estate, estates[i]) })
+	estates = append(estates, nil)
+	copy(estates[i+1:], estates[i:])
+	estates[i] = estate
+	idx.doors[size] = estates
+}
+
+func (idx *estateDoorIndex) remove(estate *Estate) {
+	delete(idx.byID, estate.ID)
+	size := doorSize{width: estate.DoorWidth, height: estate.DoorHeight}
+	estates := idx.doors[size]
+	for i, e := range estates {
+		if e == estate {
+			idx.doors[size] = append(estates[:i], estates[i+1:]...)
+			break
+		}
+	}
+}
+
+// recommendedFootprints recommendedEstateCache に載せた断面。
+// sc.Cache はキーを列挙できないので、選んで捨てるために別に覚えておく。期限切れで消えたものが残っていてもよい。
+// generation は捨てるたびに増やし、捨てる前のインデックスから作った値を載せないために使う
+var recommendedFootprints = struct {
+	sync.Mutex
+	m          map[chairFootprint]struct{}
+	generation uint64
+}{m: map[chairFootprint]struct{}{}}
+
+// loadRecommendedEstates recommendedEstateCache の値を作る。
+// 検索している間に捨てる処理が走った場合は、検索結果が古いかもしれないので検索し直す
+func loadRecommendedEstates(_ context.Context, fp chairFootprint) ([]Estate, error) {
+	for {
+		recommendedFootprints.Lock()
+		generation := recommendedFootprints.generation
+		recommendedFootprints.Unlock()
+
+		estates := estateRecommendIndex.Search(fp.fit(fitClearance, fitAllowTilt), Limit)
+
+		recommendedFootprints.Lock()
+		if recommendedFootprints.generation == generation {
+			recommendedFootprints.m[fp] = struct{}{}
+			recommendedFootprints.Unlock()
+			return estates, nil
+		}
+		recommendedFootprints.Unlock()
+	}
+}
+
+// forgetRecommendedEstates doors のいずれかを通る断面のおすすめ物件だけをキャッシュから捨てる
+func forgetRecommendedEstates(doors []doorSize) {
+	recommendedFootprints.Lock()
+	defer recommendedFootprints.Unlock()
+	recommendedFootprints.generation++
+	for fp := range recommendedFootprints.m {
+		for _, door := range doors {
+			if fp.fits(door) {
+				recommendedEstateCache.Forget(fp)
+				delete(recommendedFootprints.m, fp)
+				break
+			}
+		}
+	}
+}
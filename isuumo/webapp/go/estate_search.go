@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/url"
+)
+
+// EstateSearchQuery /api/estate/search の検索条件
+type EstateSearchQuery struct {
+	DoorHeight *Range
+	DoorWidth  *Range
+	Rent       *Range
+	Features   FeatureFilter
+
+	// RentBound などは rentMin, rentMax のような自由な範囲の指定で、Rent などと組み合わせて絞り込む
+	DoorHeightBound *Range
+	DoorWidthBound  *Range
+	RentBound       *Range
+
+	Text *textQuery
+}
+
+// parseEstateSearchQuery クエリパラメータから検索条件を作る。保存された検索条件の照合にも使う
+func parseEstateSearchQuery(params url.Values) (*EstateSearchQuery, error) {
+	q := &EstateSearchQuery{}
+	var err error
+	if q.DoorHeight, err = parseRangeParam(params, "doorHeightRangeId", estateSearchCondition.DoorHeight); err != nil {
+		return nil, err
+	}
+	if q.DoorWidth, err = parseRangeParam(params, "doorWidthRangeId", estateSearchCondition.DoorWidth); err != nil {
+		return nil, err
+	}
+	if q.Rent, err = parseRangeParam(params, "rentRangeId", estateSearchCondition.Rent); err != nil {
+		return nil, err
+	}
+	if q.Features, err = parseFeatureFilter(estateFeatureTags, params); err != nil {
+		return nil, err
+	}
+	if q.DoorHeightBound, err = parseBoundParams(params, "doorHeight", searchMaxSize); err != nil {
+		return nil, err
+	}
+	if q.DoorWidthBound, err = parseBoundParams(params, "doorWidth", searchMaxSize); err != nil {
+		return nil, err
+	}
+	if q.RentBound, err = parseBoundParams(params, "rent", searchMaxPrice); err != nil {
+		return nil, err
+	}
+	if q.Text, err = parseTextQuery(params.Get("q")); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *EstateSearchQuery) isEmpty() bool {
+	return q.DoorHeight == nil && q.DoorWidth == nil && q.Rent == nil && q.Features.isEmpty() &&
+		q.DoorHeightBound == nil && q.DoorWidthBound == nil && q.RentBound == nil &&
+		q.Text == nil
+}
+
+func (q *EstateSearchQuery) hasText() bool {
+	return q.Text != nil
+}
+
+// conditions 検索条件を WHERE 句の条件とパラメータにする
+func (q *EstateSearchQuery) conditions() ([]string, []interface{}) {
+	conditions := make([]string, 0)
+	params := make([]interface{}, 0)
+
+	rangeCondition := func(column string, r *Range) {
+		cs, ps := rangeConditions(column, r)
+		conditions = append(conditions, cs...)
+		params = append(params, ps...)
+	}
+	rangeCondition("door_height", q.DoorHeight)
+	rangeCondition("door_width", q.DoorWidth)
+	rangeCondition("rent", q.Rent)
+	// 自由な範囲も区分と同じ door_height_id などのインデックスで範囲検索になる
+	rangeCondition("door_height", q.DoorHeightBound)
+	rangeCondition("door_width", q.DoorWidthBound)
+	rangeCondition("rent", q.RentBound)
+
+	if q.Features.All != 0 {
+		conditions = append(conditions, "features_mask & ? = ?")
+		params = append(params, q.Features.All, q.Features.All)
+	}
+	if q.Features.Any != 0 {
+		conditions = append(conditions, "features_mask & ? != 0")
+		params = append(params, q.Features.Any)
+	}
+	if q.Features.None != 0 {
+		conditions = append(conditions, "features_mask & ? = 0")
+		params = append(params, q.Features.None)
+	}
+	if q.Text != nil {
+		conditions = append(conditions, textMatchSQL)
+		params = append(params, q.Text.against())
+	}
+	return conditions, params
+}
+
+// match conditions と同じ条件をメモリ上の物件に対して判定する
+func (q *EstateSearchQuery) match(estate *Estate) bool {
+	if !inRange(q.DoorHeight, estate.DoorHeight) || !inRange(q.DoorWidth, estate.DoorWidth) || !inRange(q.Rent, estate.Rent) {
+		return false
+	}
+	if !inRange(q.DoorHeightBound, estate.DoorHeight) || !inRange(q.DoorWidthBound, estate.DoorWidth) || !inRange(q.RentBound, estate.Rent) {
+		return false
+	}
+	if q.Text != nil && !q.Text.match(estate.ID) {
+		return false
+	}
+	return q.Features.match(estate.FeatureMask)
+}
+
+// rangeConditions column が r に含まれる条件を返す。r が nil の場合は条件なしとする
+func rangeConditions(column string, r *Range) ([]string, []interface{}) {
+	conditions := make([]string, 0, 2)
+	params := make([]interface{}, 0, 2)
+	if r == nil {
+		return conditions, params
+	}
+	if r.Min != -1 {
+		conditions = append(conditions, column+" >= ?")
+		params = append(params, r.Min)
+	}
+	if r.Max != -1 {
+		conditions = append(conditions, column+" < ?")
+		params = append(params, r.Max)
+	}
+	return conditions, params
+}
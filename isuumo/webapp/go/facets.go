@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Facets 絞り込みの各値を選んだときの件数。facet の名前、値の順に引く
+type Facets map[string]map[string]int64
+
+// newFacets 要求された絞り込みを一致する値がなくても空の件数で返すように、names ごとに空の件数を入れておく
+func newFacets(names []string) Facets {
+	f := make(Facets, len(names))
+	for _, name := range names {
+		f[name] = map[string]int64{}
+	}
+	return f
+}
+
+func (f Facets) add(name, value string, n int64) {
+	if f[name] == nil {
+		f[name] = map[string]int64{}
+	}
+	f[name][value] += n
+}
+
+// parseFacets facets パラメータを読む。省略された場合は nil を返す
+func parseFacets(params url.Values, names []string) ([]string, error) {
+	if params.Get("facets") == "" {
+		return nil, nil
+	}
+	facets := strings.Split(params.Get("facets"), ",")
+	for _, f := range facets {
+		if !contains(names, f) {
+			return nil, invalidSearchParam("facets", "unknown facet %v, must be one of %s", f, strings.Join(names, ", "))
+		}
+	}
+	return facets, nil
+}
+
+// chairFacet 椅子の絞り込みの1つ。
+// clear が nil でないものは、その絞り込み自身を外した結果で件数を数える (別の値を選び直したときの件数になる)。
+// feature のように AND で追加していく絞り込みは、今の結果のうちその値を持つものを数える
+type chairFacet struct {
+	name   string
+	clear  func(q *ChairSearchQuery)
+	match  func(q *ChairSearchQuery, chair *Chair) bool
+	values func(chair *Chair) []string
+}
+
+func chairRangeFacet(name string, cond func() RangeCondition, field func(q *ChairSearchQuery) **Range, value func(chair *Chair) int64) chairFacet {
+	return chairFacet{
+		name:  name,
+		clear: func(q *ChairSearchQuery) { *field(q) = nil },
+		match: func(q *ChairSearchQuery, chair *Chair) bool { return inRange(*field(q), value(chair)) },
+		values: func(chair *Chair) []string {
+			if r := findRange(cond(), value(chair)); r != nil {
+				return []string{strconv.FormatInt(r.ID, 10)}
+			}
+			return nil
+		},
+	}
+}
+
+var chairFacets = []chairFacet{
+	{
+		name:   "color",
+		clear:  func(q *ChairSearchQuery) { q.Color = "" },
+		match:  func(q *ChairSearchQuery, chair *Chair) bool { return q.Color == "" || chair.Color == q.Color },
+		values: func(chair *Chair) []string { return []string{chair.Color} },
+	},
+	{
+		name:   "kind",
+		clear:  func(q *ChairSearchQuery) { q.Kind = "" },
+		match:  func(q *ChairSearchQuery, chair *Chair) bool { return q.Kind == "" || chair.Kind == q.Kind },
+		values: func(chair *Chair) []string { return []string{chair.Kind} },
+	},
+	chairRangeFacet("priceRange", func() RangeCondition { return chairSearchCondition.Price },
+		func(q *ChairSearchQuery) **Range { return &q.Price }, func(chair *Chair) int64 { return chair.Price }),
+	chairRangeFacet("heightRange", func() RangeCondition { return chairSearchCondition.Height },
+		func(q *ChairSearchQuery) **Range { return &q.Height }, func(chair *Chair) int64 { return chair.Height }),
+	chairRangeFacet("widthRange", func() RangeCondition { return chairSearchCondition.Width },
+		func(q *ChairSearchQuery) **Range { return &q.Width }, func(chair *Chair) int64 { return chair.Width }),
+	chairRangeFacet("depthRange", func() RangeCondition { return chairSearchCondition.Depth },
+		func(q *ChairSearchQuery) **Range { return &q.Depth }, func(chair *Chair) int64 { return chair.Depth }),
+	{
+		name:   "feature",
+		values: func(chair *Chair) []string { return chairFeatureTags.names(chair.FeatureMask) },
+	},
+}
+
+var chairFacetNames = func() []string {
+	names := make([]string, 0, len(chairFacets))
+	for _, f := range chairFacets {
+		names = append(names, f.name)
+	}
+	return names
+}()
+
+// Facets names の絞り込みごとの件数をインデックスを1回走査して数える。
+// 自身を外して数える絞り込みをすべて外した条件で候補を読み、
+// 外した絞り込みのうち1つだけに一致しない椅子はその絞り込みの件数にだけ数える
+func (idx *chairIndex) Facets(q *ChairSearchQuery, names []string) Facets {
+	relaxed := *q
+	requested := make([]chairFacet, 0, len(names))
+	disjunctive := make([]chairFacet, 0, len(names))
+	for _, f := range chairFacets {
+		if !contains(names, f.name) {
+			continue
+		}
+		requested = append(requested, f)
+		if f.clear != nil {
+			f.clear(&relaxed)
+			disjunctive = append(disjunctive, f)
+		}
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	facets := newFacets(names)
+	for _, chair := range idx.candidates(&relaxed) {
+		if !relaxed.match(chair) {
+			continue
+		}
+		failed := ""
+		failures := 0
+		for _, f := range disjunctive {
+			if !f.match(q, chair) {
+				failed = f.name
+				failures++
+			}
+		}
+		if failures > 1 {
+			continue
+		}
+		for _, f := range requested {
+			if failures == 1 && f.name != failed {
+				continue
+			}
+			for _, v := range f.values(chair) {
+				facets.add(f.name, v, 1)
+			}
+		}
+	}
+	return facets
+}
+
+// estateFacet 物件の区分の絞り込みの1つ。椅子の区分と同じく自身を外した結果で件数を数える
+type estateFacet struct {
+	name   string
+	column string
+	cond   func() RangeCondition
+	field  func(q *EstateSearchQuery) **Range
+}
+
+var estateFacets = []estateFacet{
+	{"rentRange", "rent", func() RangeCondition { return estateSearchCondition.Rent }, func(q *EstateSearchQuery) **Range { return &q.Rent }},
+	{"doorWidthRange", "door_width", func() RangeCondition { return estateSearchCondition.DoorWidth }, func(q *EstateSearchQuery) **Range { return &q.DoorWidth }},
+	{"doorHeightRange", "door_height", func() RangeCondition { return estateSearchCondition.DoorHeight }, func(q *EstateSearchQuery) **Range { return &q.DoorHeight }},
+}
+
+var estateFacetNames = []string{"rentRange", "doorWidthRange", "doorHeightRange", "feature"}
+
+// sqlConjunction 条件を AND でつなぐ。条件がなければ TRUE にする
+func sqlConjunction(conditions []string) string {
+	if len(conditions) == 0 {
+		return "TRUE"
+	}
+	return "(" + strings.Join(conditions, " AND ") + ")"
+}
+
+// estateFacetCounts names の絞り込みごとの件数を1回の集計クエリで数える。
+// 自身を外して数える絞り込みをすべて外した条件で WHERE を作り、各値の件数は SUM(条件) で同時に数える
+func estateFacetCounts(db *sqlx.DB, q *EstateSearchQuery, names []string) (Facets, error) {
+	relaxed := *q
+	requested := make([]estateFacet, 0, len(names))
+	own := map[string]string{}
+	ownParams := map[string][]interface{}{}
+	for _, f := range estateFacets {
+		if !contains(names, f.name) {
+			continue
+		}
+		requested = append(requested, f)
+		cs, ps := rangeConditions(f.column, *f.field(q))
+		own[f.name], ownParams[f.name] = sqlConjunction(cs), ps
+		*f.field(&relaxed) = nil
+	}
+
+	// others name 以外の外した絞り込みをすべて満たす条件
+	others := func(name string) ([]string, []interface{}) {
+		cs := []string{}
+		ps := []interface{}{}
+		for _, f := range requested {
+			if f.name != name {
+				cs = append(cs, own[f.name])
+				ps = append(ps, ownParams[f.name]...)
+			}
+		}
+		return cs, ps
+	}
+
+	type column struct{ facet, value string }
+	columns := []column{}
+	exprs := []string{}
+	params := []interface{}{}
+	for _, f := range requested {
+		for _, r := range f.cond().Ranges {
+			cs, ps := others(f.name)
+			rc, rp := rangeConditions(f.column, r)
+			exprs = append(exprs, fmt.Sprintf("COALESCE(SUM(%s), 0)", sqlConjunction(append(cs, rc...))))
+			params = append(append(params, ps...), rp...)
+			columns = append(columns, column{f.name, strconv.FormatInt(r.ID, 10)})
+		}
+	}
+	if contains(names, "feature") {
+		cs, ps := others("")
+		for i, name := range estateFeatureTags.list {
+			exprs = append(exprs, fmt.Sprintf("COALESCE(SUM(%s), 0)", sqlConjunction(append(cs, "features_mask & ? != 0"))))
+			params = append(append(params, ps...), uint64(1)<<uint(i))
+			columns = append(columns, column{"feature", name})
+		}
+	}
+
+	facets := newFacets(names)
+	if len(exprs) == 0 {
+		return facets, nil
+	}
+	where, whereParams := relaxed.conditions()
+	query := fmt.Sprintf("SELECT %s FROM estate WHERE %s", strings.Join(exprs, ", "), sqlConjunction(where))
+	counts := make([]int64, len(exprs))
+	dest := make([]interface{}, len(counts))
+	for i := range counts {
+		dest[i] = &counts[i]
+	}
+	if err := db.QueryRowx(query, append(params, whereParams...)...).Scan(dest...); err != nil {
+		return nil, err
+	}
+	for i, c := range columns {
+		if counts[i] > 0 {
+			facets.add(c.facet, c.value, counts[i])
+		}
+	}
+	return facets, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// featureTags 検索条件の Feature.List の各要素を features_mask の1ビットに対応させる
+type featureTags struct {
+	list []string
+	bits map[string]uint64
+}
+
+func newFeatureTags(cond ListCondition) (*featureTags, error) {
+	if len(cond.List) > 64 {
+		return nil, fmt.Errorf("too many features: %d", len(cond.List))
+	}
+	t := &featureTags{
+		list: cond.List,
+		bits: make(map[string]uint64, len(cond.List)),
+	}
+	for i, f := range cond.List {
+		t.bits[f] = 1 << uint(i)
+	}
+	return t, nil
+}
+
+// mask カンマ区切りの features をビットマスクに変換する。未知の特徴は無視する
+func (t *featureTags) mask(features string) uint64 {
+	var m uint64
+	for _, f := range splitFeatures(features) {
+		m |= t.bits[f]
+	}
+	return m
+}
+
+// names ビットマスクに含まれる特徴の名前を返す
+func (t *featureTags) names(mask uint64) []string {
+	names := make([]string, 0, bits.OnesCount64(mask))
+	for i, f := range t.list {
+		if mask&(1<<uint(i)) != 0 {
+			names = append(names, f)
+		}
+	}
+	return names
+}
+
+// parse 検索パラメータのカンマ区切りの特徴をビットマスクに変換する
+func (t *featureTags) parse(param string) (uint64, error) {
+	var m uint64
+	for _, f := range splitFeatures(param) {
+		bit, ok := t.bits[f]
+		if !ok {
+			return 0, fmt.Errorf("Unexpected feature: %v", f)
+		}
+		m |= bit
+	}
+	return m, nil
+}
+
+// fillMasks features_mask が埋まっていない行を features 列から埋める。
+// CSV の入稿では行ごとに計算するが、/initialize や init.sh のように SQL で直接読み込んだ行は 0 のままなので、
+// 起動時と /initialize で呼ぶ
+func (t *featureTags) fillMasks(db *sqlx.DB, table string) error {
+	if len(t.list) == 0 {
+		return nil
+	}
+	terms := make([]string, 0, len(t.list))
+	params := make([]interface{}, 0, len(t.list))
+	for i, f := range t.list {
+		terms = append(terms, fmt.Sprintf("((FIND_IN_SET(?, features) > 0) << %d)", i))
+		params = append(params, f)
+	}
+	query := fmt.Sprintf("UPDATE `%s` SET features_mask = %s WHERE features_mask = 0 AND features != ''", table, strings.Join(terms, " | "))
+	_, err := db.Exec(query, params...)
+	return err
+}
+
+func splitFeatures(features string) []string {
+	if features == "" {
+		return nil
+	}
+	return strings.Split(features, ",")
+}
+
+// FeatureFilter features の AND/OR/NOT 条件
+type FeatureFilter struct {
+	All  uint64
+	Any  uint64
+	None uint64
+}
+
+func (f FeatureFilter) isEmpty() bool {
+	return f.All == 0 && f.Any == 0 && f.None == 0
+}
+
+func (f FeatureFilter) match(mask uint64) bool {
+	if mask&f.All != f.All {
+		return false
+	}
+	if f.Any != 0 && mask&f.Any == 0 {
+		return false
+	}
+	return mask&f.None == 0
+}
+
+// parseFeatureFilter features, featuresAll, featuresAny, featuresNone パラメータを読む。
+// features は互換性のため featuresAll と同じ扱いにする
+func parseFeatureFilter(t *featureTags, params url.Values) (FeatureFilter, error) {
+	var filter FeatureFilter
+	fields := []struct {
+		name string
+		dst  *uint64
+	}{
+		{"features", &filter.All},
+		{"featuresAll", &filter.All},
+		{"featuresAny", &filter.Any},
+		{"featuresNone", &filter.None},
+	}
+	for _, f := range fields {
+		m, err := t.parse(params.Get(f.name))
+		if err != nil {
+			return filter, invalidSearchParam(f.name, "%s", err)
+		}
+		*f.dst |= m
+	}
+	return filter, nil
+}
+
+// maskBits ビットマスクを立っているビットごとに分解する
+func maskBits(mask uint64) []uint64 {
+	bs := make([]uint64, 0, bits.OnesCount64(mask))
+	for mask != 0 {
+		bit := mask & -mask
+		bs = append(bs, bit)
+		mask ^= bit
+	}
+	return bs
+}
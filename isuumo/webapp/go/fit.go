@@ -0,0 +1,74 @@
+package main
+
+import "math"
+
+var (
+	// fitClearance 椅子を扉に通すときに各辺に確保する余裕 (cm)
+	fitClearance int64 = 0
+	// fitAllowTilt 椅子を扉の面内で傾けて通すことを許すか
+	fitAllowTilt = false
+)
+
+// fitEpsilon 浮動小数点の誤差で通るはずの椅子を弾かないための許容幅
+const fitEpsilon = 1e-9
+
+// chairFit 椅子の最小断面。扉を通るかどうかはこの断面が扉の開口に収まるかで決まる
+type chairFit struct {
+	short float64
+	long  float64
+	tilt  bool
+}
+
+// chairFootprint 椅子の3辺のうち短い2辺。
+// どの向きで通しても断面はいずれか2辺の組になるので、短い2辺で通らなければ他の向きでも通らない
+type chairFootprint struct {
+	short int64
+	long  int64
+}
+
+func footprintOf(chair *Chair) chairFootprint {
+	a, b, c := chair.Width, chair.Height, chair.Depth
+	if a > b {
+		a, b = b, a
+	}
+	if b > c {
+		b = c
+	}
+	if a > b {
+		a, b = b, a
+	}
+	return chairFootprint{short: a, long: b}
+}
+
+// fit 各辺に clearance の余裕を足した断面を作る
+func (fp chairFootprint) fit(clearance int64, tilt bool) chairFit {
+	return chairFit{
+		short: float64(fp.short + clearance),
+		long:  float64(fp.long + clearance),
+		tilt:  tilt,
+	}
+}
+
+// fits 設定された余裕と傾けて通すかの指定で door を通るかを返す
+func (fp chairFootprint) fits(door doorSize) bool {
+	return fp.fit(fitClearance, fitAllowTilt).passes(door.width, door.height)
+}
+
+// passes 幅 doorWidth、高さ doorHeight の扉を通るかを返す
+func (f chairFit) passes(doorWidth, doorHeight int64) bool {
+	a, b := float64(doorWidth), float64(doorHeight)
+	if a < b {
+		a, b = b, a
+	}
+	if f.long <= a && f.short <= b {
+		return true
+	}
+	if !f.tilt || f.short > b || f.long <= a {
+		return false
+	}
+	// 断面の長辺が扉の長辺より長い場合は斜めにして通す。
+	// 長方形 p×q (p >= q) が a×b (a >= b) に収まる条件 (Carver, 1956)
+	p, q := f.long, f.short
+	need := (2*p*q*a + (p*p-q*q)*math.Sqrt(p*p+q*q-a*a)) / (p*p + q*q)
+	return need <= b+fitEpsilon
+}
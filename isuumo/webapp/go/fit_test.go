@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestFootprintOf(t *testing.T) {
+	tests := []struct {
+		name                 string
+		width, height, depth int64
+		want                 chairFootprint
+	}{
+		{"width and depth are short", 50, 100, 40, chairFootprint{short: 40, long: 50}},
+		{"height and depth are short", 100, 50, 40, chairFootprint{short: 40, long: 50}},
+		{"width and height are short", 40, 50, 100, chairFootprint{short: 40, long: 50}},
+		{"all sides are equal", 60, 60, 60, chairFootprint{short: 60, long: 60}},
+		{"two sides are equal", 70, 30, 30, chairFootprint{short: 30, long: 30}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chair := &Chair{Width: tt.width, Height: tt.height, Depth: tt.depth}
+			if got := footprintOf(chair); got != tt.want {
+				t.Errorf("footprintOf(%dx%dx%d) = %+v, want %+v", tt.width, tt.height, tt.depth, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChairFitPasses(t *testing.T) {
+	tests := []struct {
+		name                  string
+		fp                    chairFootprint
+		clearance             int64
+		tilt                  bool
+		doorWidth, doorHeight int64
+		want                  bool
+	}{
+		{"axis-aligned", chairFootprint{short: 40, long: 50}, 0, false, 60, 70, true},
+		{"axis-aligned on a wide door", chairFootprint{short: 40, long: 50}, 0, false, 70, 45, true},
+		{"short side too long", chairFootprint{short: 40, long: 50}, 0, false, 39, 100, false},
+		{"long side too long", chairFootprint{short: 40, long: 50}, 0, false, 45, 45, false},
+		{"boundary equal", chairFootprint{short: 40, long: 50}, 0, false, 40, 50, true},
+		{"boundary equal on a wide door", chairFootprint{short: 40, long: 50}, 0, false, 50, 40, true},
+		{"clearance fills the boundary", chairFootprint{short: 40, long: 50}, 1, false, 40, 50, false},
+		{"clearance fits", chairFootprint{short: 40, long: 50}, 1, false, 41, 51, true},
+		{"tilted", chairFootprint{short: 10, long: 110}, 0, true, 65, 100, true},
+		{"tilted but too tight", chairFootprint{short: 10, long: 110}, 0, true, 64, 100, false},
+		{"tilt not allowed", chairFootprint{short: 10, long: 110}, 0, false, 65, 100, false},
+		{"tilted but short side too long", chairFootprint{short: 70, long: 110}, 0, true, 65, 100, false},
+		{"tilted with clearance", chairFootprint{short: 9, long: 109}, 1, true, 65, 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fit := tt.fp.fit(tt.clearance, tt.tilt)
+			if got := fit.passes(tt.doorWidth, tt.doorHeight); got != tt.want {
+				t.Errorf("%+v.passes(%d, %d) = %v, want %v", fit, tt.doorWidth, tt.doorHeight, got, tt.want)
+			}
+		})
+	}
+}
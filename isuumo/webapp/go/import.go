@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// importBatchSize CSV 入稿時に1回の INSERT にまとめる行数
+var importBatchSize = 500
+
+// ImportRowError 入稿を拒否した行とその理由
+type ImportRowError struct {
+	Row    int    `json:"row"`
+	Reason string `json:"reason"`
+}
+
+// ImportMode 既存の id と重複した行の扱い
+type ImportMode string
+
+const (
+	// ImportModeInsert 重複した id の行は拒否して、残りの行を挿入する
+	ImportModeInsert ImportMode = "insert"
+	// ImportModeUpsert 重複した id の行を更新する
+	ImportModeUpsert ImportMode = "upsert"
+	// ImportModeReplace 重複した id の行を削除してから挿入し直す
+	ImportModeReplace ImportMode = "replace"
+)
+
+func parseImportMode(mode string) (ImportMode, error) {
+	switch ImportMode(mode) {
+	case "":
+		return ImportModeInsert, nil
+	case ImportModeInsert, ImportModeUpsert, ImportModeReplace:
+		return ImportMode(mode), nil
+	}
+	return "", fmt.Errorf("Unexpected mode: %v", mode)
+}
+
+// ImportReport /api/chair, /api/estate へのレスポンスの形式
+type ImportReport struct {
+	DryRun    bool             `json:"dryRun"`
+	Mode      ImportMode       `json:"mode"`
+	Accepted  int              `json:"accepted"`
+	Inserted  int              `json:"inserted"`
+	Updated   int              `json:"updated"`
+	Unchanged int              `json:"unchanged"`
+	Rejected  []ImportRowError `json:"rejected"`
+}
+
+// importTarget CSV の1行をどう読んでどのテーブルに書き込むか
+type importTarget[T any] struct {
+	table   string
+	columns []string
+	parse   func(row []string) (T, error)
+	id      func(v T) int64
+}
+
+var chairImportTarget = importTarget[Chair]{
+	table:   "chair",
+	columns: []string{"id", "name", "description", "thumbnail", "price", "height", "width", "depth", "color", "features", "features_mask", "kind", "popularity", "stock"},
+	parse:   parseChairRecord,
+	id:      func(chair Chair) int64 { return chair.ID },
+}
+
+var estateImportTarget = importTarget[Estate]{
+	table:   "estate",
+	columns: []string{"id", "name", "description", "thumbnail", "address", "latitude", "longitude", "rent", "door_height", "door_width", "features", "features_mask", "popularity"},
+	parse:   parseEstateRecord,
+	id:      func(estate Estate) int64 { return estate.ID },
+}
+
+func (t importTarget[T]) query(mode ImportMode) string {
+	names := make([]string, 0, len(t.columns))
+	updates := make([]string, 0, len(t.columns))
+	for _, col := range t.columns {
+		names = append(names, ":"+col)
+		if col != "id" {
+			updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", col, col))
+		}
+	}
+	verb := "INSERT"
+	if mode == ImportModeReplace {
+		verb = "REPLACE"
+	}
+	query := fmt.Sprintf("%s INTO `%s` (%s) VALUES (%s)", verb, t.table, strings.Join(t.columns, ", "), strings.Join(names, ", "))
+	if mode == ImportModeUpsert {
+		query += " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+	}
+	return query
+}
+
+// importRow 検証を通った CSV の行。拒否した理由を行番号で返すために番号を持っておく
+type importRow[T any] struct {
+	row   int
+	value T
+}
+
+// importedRows 入稿で書き込んだ行。Inserted はそのうち新しく挿入された行
+type importedRows[T any] struct {
+	All      []T
+	Inserted []T
+}
+
+// classify batch の id の既存の行を読み、insert モードでは既存の id と重複した行を拒否して report に記録する。
+// 書き込む行と、既存の行を id で引ける map を返す。lock には書き込む場合に行をロックする句を渡す
+func (t importTarget[T]) classify(q sqlx.Ext, lock string, mode ImportMode, batch []importRow[T], report *ImportReport) ([]T, map[int64]T, error) {
+	ids := make([]int64, 0, len(batch))
+	for _, r := range batch {
+		ids = append(ids, t.id(r.value))
+	}
+	query, params, err := sqlx.In(fmt.Sprintf("SELECT %s FROM `%s` WHERE id IN (?)%s", strings.Join(t.columns, ", "), t.table, lock), ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rows []T
+	if err := sqlx.Select(q, &rows, q.Rebind(query), params...); err != nil {
+		return nil, nil, err
+	}
+	existing := make(map[int64]T, len(rows))
+	for _, row := range rows {
+		existing[t.id(row)] = row
+	}
+
+	values := make([]T, 0, len(batch))
+	for _, r := range batch {
+		id := t.id(r.value)
+		if _, ok := existing[id]; ok && mode == ImportModeInsert {
+			report.Accepted--
+			report.Rejected = append(report.Rejected, ImportRowError{Row: r.row, Reason: fmt.Sprintf("duplicate id: %d", id)})
+			continue
+		}
+		values = append(values, r.value)
+	}
+	return values, existing, nil
+}
+
+// write batch を書き込み、挿入・更新・変化なしの件数を report に加算して、書き込んだ行を rows に加える。
+// insert モードでは既存の id と重複した行を拒否して report に記録し、残りの行は書き込む
+func (t importTarget[T]) write(tx *sqlx.Tx, mode ImportMode, batch []importRow[T], report *ImportReport, rows *importedRows[T]) error {
+	values, existing, err := t.classify(tx, " FOR UPDATE", mode, batch, report)
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	res, err := tx.NamedExec(t.query(mode), values)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// 行ごとの affected rows は挿入で1、更新で2、変化なしで0、REPLACE での置き換えで2になる。
+	// 1つの batch に同じ id は入れないので、既存の行の数がそのまま更新か変化なしの行の数になる
+	updated := 0
+	for _, v := range values {
+		if _, ok := existing[t.id(v)]; ok {
+			updated++
+		} else {
+			rows.Inserted = append(rows.Inserted, v)
+		}
+	}
+	inserted := len(values) - updated
+	matched := updated
+	if mode == ImportModeUpsert {
+		updated = (int(affected) - inserted) / 2
+	}
+	report.Inserted += inserted
+	report.Updated += updated
+	report.Unchanged += matched - updated
+	rows.All = append(rows.All, values...)
+	return nil
+}
+
+// simulate write と同じ判定を書き込まずに行い、件数を report に加算する。
+// written はこの入稿で先に書き込んだことにした行で、後の batch ではこれを既存の行として扱う。
+// upsert モードの変化なしは、既存の行と入稿された行の列の値が全て同じものとする
+func (t importTarget[T]) simulate(db *sqlx.DB, mode ImportMode, batch []importRow[T], report *ImportReport, written map[int64]T) error {
+	values, existing, err := t.classify(db, "", mode, batch, report)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		id := t.id(v)
+		old, ok := written[id]
+		if !ok {
+			old, ok = existing[id]
+		}
+		switch {
+		case !ok:
+			report.Inserted++
+		case mode == ImportModeUpsert && reflect.DeepEqual(old, v):
+			report.Unchanged++
+		default:
+			report.Updated++
+		}
+		written[id] = v
+	}
+	return nil
+}
+
+// importCSV CSV を1行ずつ読んで検証し、通った行を importBatchSize 件ずつ
+// 1つのトランザクション内で書き込む。dryRun の場合は書き込まずに、既存の行と突き合わせた結果だけを返す
+func importCSV[T any](db *sqlx.DB, r io.Reader, target importTarget[T], mode ImportMode, dryRun bool) (*ImportReport, *importedRows[T], error) {
+	report := &ImportReport{DryRun: dryRun, Mode: mode, Rejected: []ImportRowError{}}
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	var tx *sqlx.Tx
+	if !dryRun {
+		var err error
+		tx, err = db.Beginx()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer tx.Rollback()
+	}
+
+	imported := &importedRows[T]{All: []T{}, Inserted: []T{}}
+	simulated := map[int64]T{}
+	batch := make([]importRow[T], 0, importBatchSize)
+	// inBatch は batch に入っている id、seen は insert モードでこの入稿で既に受け付けた id
+	inBatch := map[int64]bool{}
+	seen := map[int64]int{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var err error
+		if dryRun {
+			err = target.simulate(db, mode, batch, report, simulated)
+		} else {
+			err = target.write(tx, mode, batch, report, imported)
+		}
+		if err != nil {
+			return err
+		}
+		batch = batch[:0]
+		inBatch = map[int64]bool{}
+		return nil
+	}
+
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, nil, err
+			}
+			report.Rejected = append(report.Rejected, ImportRowError{Row: row, Reason: parseErr.Err.Error()})
+			continue
+		}
+
+		v, err := target.parse(record)
+		if err != nil {
+			report.Rejected = append(report.Rejected, ImportRowError{Row: row, Reason: err.Error()})
+			continue
+		}
+		id := target.id(v)
+		if mode == ImportModeInsert {
+			if first, ok := seen[id]; ok {
+				report.Rejected = append(report.Rejected, ImportRowError{Row: row, Reason: fmt.Sprintf("duplicate id: %d (row %d)", id, first)})
+				continue
+			}
+			seen[id] = row
+		} else if inBatch[id] {
+			// 同じ id を1つの batch に入れると件数が数えられないので、先の行を書き込んでから更新として扱う
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+		}
+		report.Accepted++
+		batch = append(batch, importRow[T]{row: row, value: v})
+		inBatch[id] = true
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, nil, err
+	}
+
+	if dryRun {
+		return report, nil, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return report, imported, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseChairRecord CSV の1行を椅子として読み、値を検証する
+func parseChairRecord(row []string) (Chair, error) {
+	rm := RecordMapper{Record: row}
+	id := rm.NextInt()
+	name := rm.NextString()
+	description := rm.NextString()
+	thumbnail := rm.NextString()
+	price := rm.NextInt()
+	height := rm.NextInt()
+	width := rm.NextInt()
+	depth := rm.NextInt()
+	color := rm.NextString()
+	features := rm.NextString()
+	kind := rm.NextString()
+	popularity := rm.NextInt()
+	stock := rm.NextInt()
+	if err := rm.Done(); err != nil {
+		return Chair{}, err
+	}
+
+	switch {
+	case id <= 0:
+		return Chair{}, fmt.Errorf("invalid id: %d", id)
+	case price < 0:
+		return Chair{}, fmt.Errorf("invalid price: %d", price)
+	case height <= 0 || width <= 0 || depth <= 0:
+		return Chair{}, fmt.Errorf("invalid size: %dx%dx%d", width, height, depth)
+	case popularity < 0:
+		return Chair{}, fmt.Errorf("invalid popularity: %d", popularity)
+	case stock < 0:
+		return Chair{}, fmt.Errorf("invalid stock: %d", stock)
+	case !contains(chairSearchCondition.Color.List, color):
+		return Chair{}, fmt.Errorf("unknown color: %v", color)
+	case !contains(chairSearchCondition.Kind.List, kind):
+		return Chair{}, fmt.Errorf("unknown kind: %v", kind)
+	}
+	featureMask, err := chairFeatureTags.parse(features)
+	if err != nil {
+		return Chair{}, err
+	}
+
+	return Chair{
+		ID:          int64(id),
+		Name:        name,
+		Description: description,
+		Thumbnail:   thumbnail,
+		Price:       int64(price),
+		Height:      int64(height),
+		Width:       int64(width),
+		Depth:       int64(depth),
+		Color:       color,
+		Features:    features,
+		FeatureMask: featureMask,
+		Kind:        kind,
+		Popularity:  int64(popularity),
+		Stock:       int64(stock),
+	}, nil
+}
+
+// parseEstateRecord CSV の1行を物件として読み、値を検証する
+func parseEstateRecord(row []string) (Estate, error) {
+	rm := RecordMapper{Record: row}
+	id := rm.NextInt()
+	name := rm.NextString()
+	description := rm.NextString()
+	thumbnail := rm.NextString()
+	address := rm.NextString()
+	latitude := rm.NextFloat()
+	longitude := rm.NextFloat()
+	rent := rm.NextInt()
+	doorHeight := rm.NextInt()
+	doorWidth := rm.NextInt()
+	features := rm.NextString()
+	popularity := rm.NextInt()
+	if err := rm.Done(); err != nil {
+		return Estate{}, err
+	}
+
+	switch {
+	case id <= 0:
+		return Estate{}, fmt.Errorf("invalid id: %d", id)
+	case latitude < -90 || 90 < latitude:
+		return Estate{}, fmt.Errorf("invalid latitude: %v", latitude)
+	case longitude < -180 || 180 < longitude:
+		return Estate{}, fmt.Errorf("invalid longitude: %v", longitude)
+	case rent < 0:
+		return Estate{}, fmt.Errorf("invalid rent: %d", rent)
+	case doorHeight <= 0 || doorWidth <= 0:
+		return Estate{}, fmt.Errorf("invalid door size: %dx%d", doorWidth, doorHeight)
+	case popularity < 0:
+		return Estate{}, fmt.Errorf("invalid popularity: %d", popularity)
+	}
+	featureMask, err := estateFeatureTags.parse(features)
+	if err != nil {
+		return Estate{}, err
+	}
+
+	return Estate{
+		ID:          int64(id),
+		Thumbnail:   thumbnail,
+		Name:        name,
+		Description: description,
+		Latitude:    latitude,
+		Longitude:   longitude,
+		Address:     address,
+		Rent:        int64(rent),
+		DoorHeight:  int64(doorHeight),
+		DoorWidth:   int64(doorWidth),
+		Features:    features,
+		FeatureMask: featureMask,
+		Popularity:  int64(popularity),
+	}, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// jobQueue ハンドラから後回しにする処理の待ち行列。積んだ順に1つの goroutine で実行する。
+// 積む側を待たせず、溢れて捨てることもないように上限は設けない
+type jobQueue struct {
+	name string
+
+	mu   sync.Mutex
+	jobs []func() error
+	wake chan struct{}
+}
+
+func newJobQueue(name string) *jobQueue {
+	return &jobQueue{name: name, wake: make(chan struct{}, 1)}
+}
+
+func (q *jobQueue) push(job func() error) {
+	q.mu.Lock()
+	q.jobs = append(q.jobs, job)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *jobQueue) pop() func() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.jobs) == 0 {
+		return nil
+	}
+	job := q.jobs[0]
+	q.jobs[0] = nil
+	q.jobs = q.jobs[1:]
+	return job
+}
+
+func (q *jobQueue) run() {
+	for range q.wake {
+		for job := q.pop(); job != nil; job = q.pop() {
+			q.do(job)
+		}
+	}
+}
+
+// do job を実行し、失敗した場合は outbox と同じ間隔を空けて outboxMaxAttempts 回まで試す。
+// 後の処理は待たせるが、DB が落ちている間は後の処理も失敗するので順番を守る方を選ぶ
+func (q *jobQueue) do(job func() error) {
+	for attempts := 1; ; attempts++ {
+		err := job()
+		if err == nil {
+			return
+		}
+		if attempts >= outboxMaxAttempts {
+			log.Errorf("%v job failed %d times, giving up : %v", q.name, attempts, err)
+			return
+		}
+		log.Errorf("%v job failed, retrying : %v", q.name, err)
+		time.Sleep(outboxBackoff(attempts))
+	}
+}
@@ -3,12 +3,12 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -33,6 +33,8 @@ var mySQLConnectionDataChair *MySQLConnectionEnv
 var mySQLConnectionDataEstate *MySQLConnectionEnv
 var chairSearchCondition ChairSearchCondition
 var estateSearchCondition EstateSearchCondition
+var chairFeatureTags *featureTags
+var estateFeatureTags *featureTags
 
 type InitializeResponse struct {
 	Language string `json:"language"`
@@ -44,25 +46,26 @@ type Chair struct {
 	Description string `db:"description" json:"description"`
 	Thumbnail   string `db:"thumbnail" json:"thumbnail"`
 	Price       int64  `db:"price" json:"price"`
-	PriceRange  int64  `db:"price_range" json:"-"`
 	Height      int64  `db:"height" json:"height"`
-	HeightRange int64  `db:"height_range" json:"-"`
 	Width       int64  `db:"width" json:"width"`
-	WidthRange  int64  `db:"width_range" json:"-"`
 	Depth       int64  `db:"depth" json:"depth"`
-	DepthRange  int64  `db:"depth_range" json:"-"`
 	Color       string `db:"color" json:"color"`
 	Features    string `db:"features" json:"features"`
+	FeatureMask uint64 `db:"features_mask" json:"-"`
 	Kind        string `db:"kind" json:"kind"`
 	Popularity  int64  `db:"popularity" json:"-"`
 	PopularityM int64  `db:"popularity_m" json:"-"`
 	Stock       int64  `db:"stock" json:"-"`
+	StockOrder  int64  `db:"stock_order_id" json:"-"`
+	StockResv   int64  `db:"stock_reservation_id" json:"-"`
 	InStock     bool   `db:"in_stock" json:"-"`
 }
 
 type ChairSearchResponse struct {
-	Count  int64   `json:"count"`
-	Chairs []Chair `json:"chairs"`
+	Count      int64   `json:"count"`
+	Chairs     []Chair `json:"chairs"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+	Facets     *Facets `json:"facets,omitempty"`
 }
 
 type ChairListResponse struct {
@@ -71,29 +74,30 @@ type ChairListResponse struct {
 
 // Estate 物件
 type Estate struct {
-	ID          int64       `db:"id" json:"id"`
-	Thumbnail   string      `db:"thumbnail" json:"thumbnail"`
-	Name        string      `db:"name" json:"name"`
-	Description string      `db:"description" json:"description"`
-	Latitude    float64     `db:"latitude" json:"latitude"`
-	Longitude   float64     `db:"longitude" json:"longitude"`
-	Address     string      `db:"address" json:"address"`
-	Rent        int64       `db:"rent" json:"rent"`
-	RentRange   int64       `db:"rent_range" json:"-"`
-	DoorHeight  int64       `db:"door_height" json:"doorHeight"`
-	DoorHRange  int64       `db:"door_height_range" json:"-"`
-	DoorWidth   int64       `db:"door_width" json:"doorWidth"`
-	DoorWRange  int64       `db:"door_width_range" json:"-"`
-	Features    string      `db:"features" json:"features"`
-	Popularity  int64       `db:"popularity" json:"-"`
-	PopularityM int64       `db:"popularity_m" json:"-"`
-	Point       interface{} `db:"point" json:"-"`
+	ID          int64   `db:"id" json:"id"`
+	Thumbnail   string  `db:"thumbnail" json:"thumbnail"`
+	Name        string  `db:"name" json:"name"`
+	Description string  `db:"description" json:"description"`
+	Latitude    float64 `db:"latitude" json:"latitude"`
+	Longitude   float64 `db:"longitude" json:"longitude"`
+	Address     string  `db:"address" json:"address"`
+	Rent        int64   `db:"rent" json:"rent"`
+	DoorHeight  int64   `db:"door_height" json:"doorHeight"`
+	DoorWidth   int64   `db:"door_width" json:"doorWidth"`
+	Features    string  `db:"features" json:"features"`
+	FeatureMask uint64  `db:"features_mask" json:"-"`
+	Popularity  int64   `db:"popularity" json:"-"`
+	PopularityM int64   `db:"popularity_m" json:"-"`
+	// Relevance q パラメータで検索したときの関連度
+	Relevance float64 `db:"relevance" json:"-"`
 }
 
 // EstateSearchResponse estate/searchへのレスポンスの形式
 type EstateSearchResponse struct {
-	Count   int64    `json:"count"`
-	Estates []Estate `json:"estates"`
+	Count      int64    `json:"count"`
+	Estates    []Estate `json:"estates"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+	Facets     *Facets  `json:"facets,omitempty"`
 }
 
 type EstateListResponse struct {
@@ -155,6 +159,8 @@ type MySQLConnectionEnv struct {
 	User     string
 	DBName   string
 	Password string
+	// Replicas 読み込みを振り分けるレプリカのホスト
+	Replicas []string
 }
 
 type RecordMapper struct {
@@ -215,13 +221,25 @@ func (r *RecordMapper) Err() error {
 	return r.err
 }
 
-func NewMySQLConnectionEnv(hostEnvName string) *MySQLConnectionEnv {
+// Done 全ての列を読み終えたかを確認する
+func (r *RecordMapper) Done() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.offset != len(r.Record) {
+		r.err = fmt.Errorf("too many columns: %d", len(r.Record))
+	}
+	return r.err
+}
+
+func NewMySQLConnectionEnv(hostEnvName, replicasEnvName string) *MySQLConnectionEnv {
 	return &MySQLConnectionEnv{
 		Host:     getEnv(hostEnvName, "127.0.0.1"),
 		Port:     getEnv("MYSQL_PORT", "3306"),
 		User:     getEnv("MYSQL_USER", "isucon"),
 		DBName:   getEnv("MYSQL_DBNAME", "isuumo"),
 		Password: getEnv("MYSQL_PASS", "isucon"),
+		Replicas: parseReplicaHosts(getEnv(replicasEnvName, "")),
 	}
 }
 
@@ -235,24 +253,37 @@ func getEnv(key, defaultValue string) string {
 
 // ConnectDB isuumoデータベースに接続する
 func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?interpolateParams=true", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
-	return sqlx.Open("mysql", dsn)
+	return sqlx.Open("mysql", mc.dsn())
 }
 
-func init() {
+func (mc *MySQLConnectionEnv) dsn() string {
+	return fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?interpolateParams=true&parseTime=true", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
+}
+
+// loadSearchConditions 検索条件の定義を読む。
+// 定義は初期データと一緒に生成されてリポジトリには入らないので、init ではなく main から読み、テストからは読まない
+func loadSearchConditions() error {
 	jsonText, err := ioutil.ReadFile("../fixture/chair_condition.json")
 	if err != nil {
-		fmt.Printf("%v\n", err)
-		os.Exit(1)
+		return err
+	}
+	if err := json.Unmarshal(jsonText, &chairSearchCondition); err != nil {
+		return err
 	}
-	json.Unmarshal(jsonText, &chairSearchCondition)
 
 	jsonText, err = ioutil.ReadFile("../fixture/estate_condition.json")
 	if err != nil {
-		fmt.Printf("%v\n", err)
-		os.Exit(1)
+		return err
+	}
+	if err := json.Unmarshal(jsonText, &estateSearchCondition); err != nil {
+		return err
 	}
-	json.Unmarshal(jsonText, &estateSearchCondition)
+
+	if chairFeatureTags, err = newFeatureTags(chairSearchCondition.Feature); err != nil {
+		return err
+	}
+	estateFeatureTags, err = newFeatureTags(estateSearchCondition.Feature)
+	return err
 }
 
 var (
@@ -261,9 +292,16 @@ var (
 
 	lowPricedChairCache  *sc.Cache[struct{}, []Chair]
 	lowPricedEstateCache *sc.Cache[struct{}, []Estate]
+
+	// recommendedEstateCache 断面の同じ椅子はおすすめ物件も同じになるので断面ごとに持つ
+	recommendedEstateCache *sc.Cache[chairFootprint, []Estate]
 )
 
 func main() {
+	if err := loadSearchConditions(); err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
 
 	go func() {
 		log.Fatal(http.ListenAndServe(":6060", nil))
@@ -288,6 +326,9 @@ func main() {
 	e.GET("/api/chair/low_priced", getLowPricedChair)
 	e.GET("/api/chair/search/condition", getChairSearchCondition)
 	e.POST("/api/chair/buy/:id", buyChair)
+	e.POST("/api/chair/reserve/:id", reserveChair)
+	e.GET("/api/chair/:id/orders", getChairOrders)
+	e.GET("/api/orders", getOrdersByEmail)
 
 	// Estate Handler
 	e.GET("/api/estate/:id", getEstateDetail)
@@ -295,9 +336,33 @@ func main() {
 	e.GET("/api/estate/search", searchEstates)
 	e.GET("/api/estate/low_priced", getLowPricedEstate)
 	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument)
+	e.GET("/api/estate/:id/requests", getEstateDocumentRequests)
+	e.POST("/api/estate/requests/:rid/ack", acknowledgeEstateDocumentRequest)
 	e.POST("/api/estate/nazotte", searchEstateNazotte)
 	e.GET("/api/estate/search/condition", getEstateSearchCondition)
 	e.GET("/api/recommended_estate/:id", searchRecommendedEstateWithChair)
+	e.GET("/api/recommended_chair/:estateId", searchRecommendedChairWithEstate)
+
+	// Suggest Handler
+	e.GET("/api/suggest", getSuggestions)
+
+	// Admin Handler
+	e.GET("/api/admin/outbox", getOutboxStatus)
+	e.GET("/api/admin/topology", getTopology)
+
+	// Webhook Handler
+	e.POST("/api/webhooks", postWebhookSubscription)
+	e.GET("/api/webhooks", getWebhookSubscriptions)
+	e.GET("/api/webhooks/:id", getWebhookSubscription)
+	e.PUT("/api/webhooks/:id", putWebhookSubscription)
+	e.DELETE("/api/webhooks/:id", deleteWebhookSubscription)
+	e.GET("/api/webhooks/:id/deliveries", getWebhookDeliveries)
+
+	// Saved Search Handler
+	e.POST("/api/saved_searches", postSavedSearch)
+	e.GET("/api/saved_searches", getSavedSearches)
+	e.DELETE("/api/saved_searches/:id", deleteSavedSearch)
+	e.GET("/api/saved_searches/:id/matches", getSavedSearchMatches)
 
 	// mySQLConnectionData = NewMySQLConnectionEnv("")
 
@@ -309,7 +374,7 @@ func main() {
 	// db.SetMaxOpenConns(10)
 	// defer db.Close()
 
-	mySQLConnectionDataChair = NewMySQLConnectionEnv("MYSQL_CHAIR_HOST")
+	mySQLConnectionDataChair = NewMySQLConnectionEnv("MYSQL_CHAIR_HOST", "MYSQL_CHAIR_REPLICAS")
 
 	var err error
 	chairDb, err = mySQLConnectionDataChair.ConnectDB()
@@ -319,7 +384,7 @@ func main() {
 	chairDb.SetMaxOpenConns(50)
 	defer chairDb.Close()
 
-	mySQLConnectionDataEstate = NewMySQLConnectionEnv("MYSQL_ESTATE_HOST")
+	mySQLConnectionDataEstate = NewMySQLConnectionEnv("MYSQL_ESTATE_HOST", "MYSQL_ESTATE_REPLICAS")
 
 	estateDb, err = mySQLConnectionDataEstate.ConnectDB()
 	if err != nil {
@@ -328,34 +393,72 @@ func main() {
 	estateDb.SetMaxOpenConns(50)
 	defer estateDb.Close()
 
+	readYourWritesMs, err := strconv.Atoi(getEnv("READ_YOUR_WRITES_MS", "3000"))
+	if err != nil || readYourWritesMs < 0 {
+		e.Logger.Fatalf("invalid READ_YOUR_WRITES_MS : %v", getEnv("READ_YOUR_WRITES_MS", "3000"))
+	}
+	readYourWritesWindow = time.Duration(readYourWritesMs) * time.Millisecond
+	replicaMaxLagSeconds, err := strconv.Atoi(getEnv("MYSQL_REPLICA_MAX_LAG_SECONDS", "5"))
+	if err != nil || replicaMaxLagSeconds < 0 {
+		e.Logger.Fatalf("invalid MYSQL_REPLICA_MAX_LAG_SECONDS : %v", getEnv("MYSQL_REPLICA_MAX_LAG_SECONDS", "5"))
+	}
+	replicaMaxLag = time.Duration(replicaMaxLagSeconds) * time.Second
+	replicaTimeoutMs, err := strconv.Atoi(getEnv("MYSQL_REPLICA_TIMEOUT_MS", "2000"))
+	if err != nil || replicaTimeoutMs <= 0 {
+		e.Logger.Fatalf("invalid MYSQL_REPLICA_TIMEOUT_MS : %v", getEnv("MYSQL_REPLICA_TIMEOUT_MS", "2000"))
+	}
+	replicaTimeout = time.Duration(replicaTimeoutMs) * time.Millisecond
+	replicaCheckInterval, err := strconv.Atoi(getEnv("MYSQL_REPLICA_CHECK_INTERVAL_MS", "1000"))
+	if err != nil || replicaCheckInterval <= 0 {
+		e.Logger.Fatalf("invalid MYSQL_REPLICA_CHECK_INTERVAL_MS : %v", getEnv("MYSQL_REPLICA_CHECK_INTERVAL_MS", "1000"))
+	}
+
+	chairReplicas, err = newReplicaSet(chairDb, mySQLConnectionDataChair)
+	if err != nil {
+		e.Logger.Fatalf("DB connection failed : %v", err)
+	}
+	defer chairReplicas.Close()
+	estateReplicas, err = newReplicaSet(estateDb, mySQLConnectionDataEstate)
+	if err != nil {
+		e.Logger.Fatalf("DB connection failed : %v", err)
+	}
+	defer estateReplicas.Close()
+	// 最初の確認が終わるまではどのレプリカにも振り分けない
+	chairReplicas.check()
+	estateReplicas.check()
+	go chairReplicas.run(time.Duration(replicaCheckInterval) * time.Millisecond)
+	go estateReplicas.run(time.Duration(replicaCheckInterval) * time.Millisecond)
+
+	if schemaVersion, err = readSchemaFileVersion(schemaFile); err != nil {
+		e.Logger.Fatalf("failed to read schema version : %v", err)
+	}
+	// 初期化前の DB でも起動はできるようにして、食い違いはログに残すだけにする
+	if err := checkDBVersions(DBVersion{SchemaVersion: schemaVersion}); err != nil {
+		e.Logger.Errorf("database version check failed : %v", err)
+	}
+
 	chairDetailCache = sc.NewMust[int, *Chair](func(_ context.Context, id int) (*Chair, error) {
 		var chair Chair
 		query := `SELECT * FROM chair WHERE id = ?`
-		err = chairDb.Get(&chair, query, id)
+		err = chairReplicas.readerFor(int64(id)).Get(&chair, query, id)
 		return &chair, err
 	}, 24*time.Hour, 24*time.Hour)
 	estateDetailCache = sc.NewMust[int, *Estate](func(_ context.Context, id int) (*Estate, error) {
 		var estate Estate
 		query := `SELECT * FROM estate WHERE id = ?`
-		err = estateDb.Get(&estate, query, id)
+		err = estateReplicas.readerFor(int64(id)).Get(&estate, query, id)
 		return &estate, err
 	}, 24*time.Hour, 24*time.Hour)
 	lowPricedChairCache = sc.NewMust(func(_ context.Context, _ struct{}) ([]Chair, error) {
-		var chairs []Chair
-		query := `SELECT * FROM chair WHERE in_stock = 1 ORDER BY price ASC, id ASC LIMIT ?`
-		err := chairDb.Select(&chairs, query, Limit)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				return []Chair{}, nil
-			}
-			return nil, err
-		}
-		return chairs, nil
+		// chair.stock は非同期に書き戻されるので、在庫台帳と同期している検索インデックスから作る
+		return chairSearchIndex.LowPriced(Limit), nil
 	}, 24*time.Hour, 24*time.Hour)
+	recommendedEstateCache = sc.NewMust(loadRecommendedEstates, 24*time.Hour, 24*time.Hour)
 	lowPricedEstateCache = sc.NewMust(func(_ context.Context, _ struct{}) ([]Estate, error) {
 		estates := make([]Estate, 0, Limit)
 		query := `SELECT * FROM estate ORDER BY rent ASC, id ASC LIMIT ?`
-		err := estateDb.Select(&estates, query, Limit)
+		// 入稿で捨てた直後に作り直すので、遅れているレプリカの古い一覧を 24 時間載せないようにプライマリから読む
+		err := estateReplicas.primary.Select(&estates, query, Limit)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				return []Estate{}, nil
@@ -365,12 +468,95 @@ func main() {
 		return estates, nil
 	}, 24*time.Hour, 24*time.Hour)
 
+	// init.sh で読み込んだ DB は features_mask が埋まっていないので、インデックスを作る前に埋める
+	if err := chairFeatureTags.fillMasks(chairDb, "chair"); err != nil {
+		e.Logger.Errorf("failed to update chair features_mask : %v", err)
+	}
+	if err := estateFeatureTags.fillMasks(estateDb, "estate"); err != nil {
+		e.Logger.Errorf("failed to update estate features_mask : %v", err)
+	}
+	if err := chairStockLedger.Load(chairDb); err != nil {
+		e.Logger.Errorf("failed to load chair stock ledger : %v", err)
+	}
+	if err := chairSearchIndex.Load(chairDb); err != nil {
+		e.Logger.Errorf("failed to load chair search index : %v", err)
+	}
+	if err := estateNazotteIndex.Load(estateDb); err != nil {
+		e.Logger.Errorf("failed to load estate nazotte index : %v", err)
+	}
+	if err := estateRecommendIndex.Load(estateDb); err != nil {
+		e.Logger.Errorf("failed to load estate recommend index : %v", err)
+	}
+	if err := loadSuggestIndexes(); err != nil {
+		e.Logger.Errorf("failed to load suggest indexes : %v", err)
+	}
+
+	importBatchSize, err = strconv.Atoi(getEnv("IMPORT_BATCH_SIZE", "500"))
+	if err != nil || importBatchSize <= 0 {
+		e.Logger.Fatalf("invalid IMPORT_BATCH_SIZE : %v", getEnv("IMPORT_BATCH_SIZE", "500"))
+	}
+
+	reservationMinutes, err := strconv.Atoi(getEnv("CHAIR_RESERVATION_MINUTES", "10"))
+	if err != nil || reservationMinutes <= 0 {
+		e.Logger.Fatalf("invalid CHAIR_RESERVATION_MINUTES : %v", getEnv("CHAIR_RESERVATION_MINUTES", "10"))
+	}
+	chairReservationTTL = time.Duration(reservationMinutes) * time.Minute
+	go runChairReservationReaper(10 * time.Second)
+
+	flushInterval, err := strconv.Atoi(getEnv("STOCK_FLUSH_INTERVAL_MS", "500"))
+	if err != nil || flushInterval <= 0 {
+		e.Logger.Fatalf("invalid STOCK_FLUSH_INTERVAL_MS : %v", getEnv("STOCK_FLUSH_INTERVAL_MS", "500"))
+	}
+	go runStockFlusher(time.Duration(flushInterval) * time.Millisecond)
+
+	docRequestLimit, err := strconv.Atoi(getEnv("DOC_REQUEST_LIMIT_PER_MINUTE", "10"))
+	if err != nil || docRequestLimit <= 0 {
+		e.Logger.Fatalf("invalid DOC_REQUEST_LIMIT_PER_MINUTE : %v", getEnv("DOC_REQUEST_LIMIT_PER_MINUTE", "10"))
+	}
+	documentRequestLimiter = newRateLimiter(docRequestLimit, time.Minute)
+	go documentRequestLimiter.runSweeper(time.Minute)
+
+	fitClearance, err = strconv.ParseInt(getEnv("RECOMMEND_FIT_CLEARANCE", "0"), 10, 64)
+	if err != nil || fitClearance < 0 {
+		e.Logger.Fatalf("invalid RECOMMEND_FIT_CLEARANCE : %v", getEnv("RECOMMEND_FIT_CLEARANCE", "0"))
+	}
+	fitAllowTilt, err = strconv.ParseBool(getEnv("RECOMMEND_FIT_TILT", "false"))
+	if err != nil {
+		e.Logger.Fatalf("invalid RECOMMEND_FIT_TILT : %v", getEnv("RECOMMEND_FIT_TILT", "false"))
+	}
+
+	searchMaxPerPage, err = strconv.Atoi(getEnv("SEARCH_MAX_PER_PAGE", "100"))
+	if err != nil || searchMaxPerPage <= 0 {
+		e.Logger.Fatalf("invalid SEARCH_MAX_PER_PAGE : %v", getEnv("SEARCH_MAX_PER_PAGE", "100"))
+	}
+	searchMaxPage, err = strconv.Atoi(getEnv("SEARCH_MAX_PAGE", "1000"))
+	if err != nil || searchMaxPage < 0 {
+		e.Logger.Fatalf("invalid SEARCH_MAX_PAGE : %v", getEnv("SEARCH_MAX_PAGE", "1000"))
+	}
+
+	sink, err := newOutboxSink(getEnv("OUTBOX_SINK", "stdout"))
+	if err != nil {
+		e.Logger.Fatalf("invalid OUTBOX_SINK : %v", err)
+	}
+	outboxInterval, err := strconv.Atoi(getEnv("OUTBOX_DISPATCH_INTERVAL_MS", "1000"))
+	if err != nil || outboxInterval <= 0 {
+		e.Logger.Fatalf("invalid OUTBOX_DISPATCH_INTERVAL_MS : %v", getEnv("OUTBOX_DISPATCH_INTERVAL_MS", "1000"))
+	}
+	go (&outboxDispatcher{db: chairDb, sink: sink}).run(time.Duration(outboxInterval) * time.Millisecond)
+	go (&outboxDispatcher{db: estateDb, sink: sink}).run(time.Duration(outboxInterval) * time.Millisecond)
+	go runWebhookDispatcher(time.Duration(outboxInterval) * time.Millisecond)
+	go savedSearchJobs.run()
+	go webhookJobs.run()
+
 	// Start server
 	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_PORT", "1323"))
 	e.Logger.Fatal(e.Start(serverPort))
 }
 
 func initialize(c echo.Context) error {
+	resumeFlush := chairStockLedger.PauseFlush()
+	defer resumeFlush()
+
 	sqlDir := filepath.Join("..", "mysql", "db")
 	paths := []string{
 		filepath.Join(sqlDir, "0_Schema.sql"),
@@ -416,10 +602,66 @@ func initialize(c echo.Context) error {
 		}
 	}
 
+	// それぞれの DB に読み込んだ初期データの版を、両方の DB に記録しておく
+	chairDataVersion, err := seedDataVersion(filepath.Join(sqlDir, "2_DummyChairData.sql"))
+	if err != nil {
+		c.Logger().Errorf("failed to hash chair seed data : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	estateDataVersion, err := seedDataVersion(filepath.Join(sqlDir, "1_DummyEstateData.sql"))
+	if err != nil {
+		c.Logger().Errorf("failed to hash estate seed data : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := setDataVersion(chairDb, chairDataVersion, estateDataVersion); err != nil {
+		c.Logger().Errorf("failed to set chair db data version : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := setDataVersion(estateDb, chairDataVersion, estateDataVersion); err != nil {
+		c.Logger().Errorf("failed to set estate db data version : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 書き込んだ版が両方の DB に入り、スキーマの定義を読み込んだ版がアプリケーションの前提と合っていることを確かめる
+	if err := checkDBVersions(DBVersion{SchemaVersion: schemaVersion, ChairDataVersion: chairDataVersion, EstateDataVersion: estateDataVersion}); err != nil {
+		c.Logger().Errorf("database version check failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := chairFeatureTags.fillMasks(chairDb, "chair"); err != nil {
+		c.Logger().Errorf("failed to update chair features_mask : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := estateFeatureTags.fillMasks(estateDb, "estate"); err != nil {
+		c.Logger().Errorf("failed to update estate features_mask : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := chairStockLedger.Load(chairDb); err != nil {
+		c.Logger().Errorf("failed to load chair stock ledger : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := chairSearchIndex.Load(chairDb); err != nil {
+		c.Logger().Errorf("failed to load chair search index : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := estateNazotteIndex.Load(estateDb); err != nil {
+		c.Logger().Errorf("failed to load estate nazotte index : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := estateRecommendIndex.Load(estateDb); err != nil {
+		c.Logger().Errorf("failed to load estate recommend index : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := loadSuggestIndexes(); err != nil {
+		c.Logger().Errorf("failed to load suggest indexes : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	chairDetailCache.Purge()
 	estateDetailCache.Purge()
 	lowPricedChairCache.Purge()
 	lowPricedEstateCache.Purge()
+	recommendedEstateCache.Purge()
 
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "go",
@@ -442,7 +684,7 @@ func getChairDetail(c echo.Context) error {
 		c.Echo().Logger.Errorf("Failed to get the chair from id : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	if chair.Stock <= 0 {
+	if stock, _ := chairStockLedger.Get(chair.ID); stock <= 0 {
 		c.Echo().Logger.Infof("requested id's chair is sold out : %v", id)
 		return c.NoContent(http.StatusNotFound)
 	}
@@ -462,211 +704,73 @@ func postChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
+	mode, err := parseImportMode(c.FormValue("mode"))
 	if err != nil {
-		c.Logger().Errorf("failed to read csv: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		c.Logger().Infof("invalid import mode : %v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
-
-	chairs := make([]Chair, 0, len(records))
-	for _, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		price := rm.NextInt()
-		height := rm.NextInt()
-		width := rm.NextInt()
-		depth := rm.NextInt()
-		color := rm.NextString()
-		features := rm.NextString()
-		kind := rm.NextString()
-		popularity := rm.NextInt()
-		stock := rm.NextInt()
-		if err := rm.Err(); err != nil {
-			c.Logger().Errorf("failed to read record: %v", err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-		chairs = append(chairs, Chair{
-			ID:          int64(id),
-			Name:        name,
-			Description: description,
-			Thumbnail:   thumbnail,
-			Price:       int64(price),
-			Height:      int64(height),
-			Width:       int64(width),
-			Depth:       int64(depth),
-			Color:       color,
-			Features:    features,
-			Kind:        kind,
-			Popularity:  int64(popularity),
-			Stock:       int64(stock),
-		})
-	}
-	if _, err := chairDb.NamedExec("INSERT INTO `chair` (id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock) VALUES (:id, :name, :description, :thumbnail, :price, :height, :width, :depth, :color, :features, :kind, :popularity, :stock)", chairs); err != nil {
-		c.Logger().Errorf("failed to insert chair: %v", err)
+	dryRun := c.FormValue("dryRun") == "true"
+	report, imported, err := importCSV(chairDb, f, chairImportTarget, mode, dryRun)
+	if err != nil {
+		c.Logger().Errorf("failed to import chair: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	lowPricedChairCache.Purge()
-
-	return c.NoContent(http.StatusCreated)
-}
-
-func searchChairs(c echo.Context) error {
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
-
-	if c.QueryParam("priceRangeId") != "" {
-		// chairPrice, err := getRange(chairSearchCondition.Price, c.QueryParam("priceRangeId"))
-		// if err != nil {
-		// 	c.Echo().Logger.Infof("priceRangeID invalid, %v : %v", c.QueryParam("priceRangeId"), err)
-		// 	return c.NoContent(http.StatusBadRequest)
-		// }
-
-		// if chairPrice.Min != -1 {
-		// 	conditions = append(conditions, "price >= ?")
-		// 	params = append(params, chairPrice.Min)
-		// }
-		// if chairPrice.Max != -1 {
-		// 	conditions = append(conditions, "price < ?")
-		// 	params = append(params, chairPrice.Max)
-		// }
-		rangeIndex, err := strconv.Atoi(c.QueryParam("priceRangeId"))
-		if err != nil && !(0 <= rangeIndex && rangeIndex <= 3) {
-			return c.NoContent(http.StatusBadRequest)
-		}
-		conditions = append(conditions, "price_range="+strconv.Itoa(rangeIndex))
-	}
-
-	if c.QueryParam("heightRangeId") != "" {
-		// chairHeight, err := getRange(chairSearchCondition.Height, c.QueryParam("heightRangeId"))
-		// if err != nil {
-		// 	c.Echo().Logger.Infof("heightRangeIf invalid, %v : %v", c.QueryParam("heightRangeId"), err)
-		// 	return c.NoContent(http.StatusBadRequest)
-		// }
-
-		// if chairHeight.Min != -1 {
-		// 	conditions = append(conditions, "height >= ?")
-		// 	params = append(params, chairHeight.Min)
-		// }
-		// if chairHeight.Max != -1 {
-		// 	conditions = append(conditions, "height < ?")
-		// 	params = append(params, chairHeight.Max)
-		// }
-		rangeIndex, err := strconv.Atoi(c.QueryParam("heightRangeId"))
-		if err != nil && !(0 <= rangeIndex && rangeIndex <= 3) {
-			return c.NoContent(http.StatusBadRequest)
-		}
-		conditions = append(conditions, "height_range="+strconv.Itoa(rangeIndex))
-	}
-
-	if c.QueryParam("widthRangeId") != "" {
-		// chairWidth, err := getRange(chairSearchCondition.Width, c.QueryParam("widthRangeId"))
-		// if err != nil {
-		// 	c.Echo().Logger.Infof("widthRangeID invalid, %v : %v", c.QueryParam("widthRangeId"), err)
-		// 	return c.NoContent(http.StatusBadRequest)
-		// }
-
-		// if chairWidth.Min != -1 {
-		// 	conditions = append(conditions, "width >= ?")
-		// 	params = append(params, chairWidth.Min)
-		// }
-		// if chairWidth.Max != -1 {
-		// 	conditions = append(conditions, "width < ?")
-		// 	params = append(params, chairWidth.Max)
-		// }
-		rangeIndex, err := strconv.Atoi(c.QueryParam("widthRangeId"))
-		if err != nil && !(0 <= rangeIndex && rangeIndex <= 3) {
-			return c.NoContent(http.StatusBadRequest)
-		}
-		conditions = append(conditions, "width_range="+strconv.Itoa(rangeIndex))
-	}
-
-	if c.QueryParam("depthRangeId") != "" {
-		// chairDepth, err := getRange(chairSearchCondition.Depth, c.QueryParam("depthRangeId"))
-		// if err != nil {
-		// 	c.Echo().Logger.Infof("depthRangeId invalid, %v : %v", c.QueryParam("depthRangeId"), err)
-		// 	return c.NoContent(http.StatusBadRequest)
-		// }
-
-		// if chairDepth.Min != -1 {
-		// 	conditions = append(conditions, "depth >= ?")
-		// 	params = append(params, chairDepth.Min)
-		// }
-		// if chairDepth.Max != -1 {
-		// 	conditions = append(conditions, "depth < ?")
-		// 	params = append(params, chairDepth.Max)
-		// }
-		rangeIndex, err := strconv.Atoi(c.QueryParam("depthRangeId"))
-		if err != nil && !(0 <= rangeIndex && rangeIndex <= 3) {
-			return c.NoContent(http.StatusBadRequest)
-		}
-		conditions = append(conditions, "depth_range="+strconv.Itoa(rangeIndex))
+	if dryRun {
+		return c.JSON(http.StatusOK, report)
 	}
 
-	if c.QueryParam("kind") != "" {
-		conditions = append(conditions, "kind = ?")
-		params = append(params, c.QueryParam("kind"))
+	chairs := imported.All
+	// 検索インデックスには仮押さえ中の数を引いた台帳の在庫数で入れる
+	for i := range chairs {
+		chairs[i].Stock = chairStockLedger.Set(chairs[i].ID, chairs[i].Stock)
 	}
-
-	if c.QueryParam("color") != "" {
-		conditions = append(conditions, "color = ?")
-		params = append(params, c.QueryParam("color"))
+	chairSearchIndex.Add(chairs)
+	addChairSuggestions(chairs)
+	ids := make([]int64, 0, len(chairs))
+	for _, chair := range chairs {
+		ids = append(ids, chair.ID)
+		chairDetailCache.Forget(int(chair.ID))
 	}
-
-	if c.QueryParam("features") != "" {
-		for _, f := range strings.Split(c.QueryParam("features"), ",") {
-			conditions = append(conditions, "features LIKE CONCAT('%', ?, '%')")
-			params = append(params, f)
-		}
-	}
-
-	if len(conditions) == 0 {
-		c.Echo().Logger.Infof("Search condition not found")
-		return c.NoContent(http.StatusBadRequest)
+	chairReplicas.markWritten(ids...)
+	// 台帳を上書きしてからインデックスに入れるまでに並行した購入や仮押さえの反映があっても、台帳の現在の在庫数に合わせ直す
+	for _, id := range ids {
+		applyChairStock(id)
 	}
+	// 新しく挿入された椅子だけを通知する。台帳は入稿前の仮押さえを持たないので在庫数は CSV のままでよい
+	publishWebhookEvents(webhookChairAdded, imported.Inserted)
+	lowPricedChairCache.Purge()
+	recordChairMatches(chairs)
 
-	conditions = append(conditions, "`in_stock` = 1")
+	return c.JSON(http.StatusCreated, report)
+}
 
-	page, err := strconv.Atoi(c.QueryParam("page"))
+func searchChairs(c echo.Context) error {
+	q, p, err := parseSearchParams(c.QueryParams(), parseChairSearchQuery, chairSortOrders)
 	if err != nil {
-		c.Logger().Infof("Invalid format page parameter : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return badSearchRequest(c, err)
 	}
-
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	facets, err := parseFacets(c.QueryParams(), chairFacetNames)
 	if err != nil {
-		c.Logger().Infof("Invalid format perPage parameter : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return badSearchRequest(c, err)
+	}
+	if q.Text != nil {
+		if err := q.Text.loadScores(chairReplicas.reader()); err != nil {
+			c.Logger().Errorf("searchChairs DB execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
 	}
-
-	searchQuery := "SELECT * FROM chair WHERE "
-	countQuery := "SELECT COUNT(*) FROM chair WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity_m ASC, id ASC LIMIT ? OFFSET ?"
 
 	var res ChairSearchResponse
-	err = chairDb.Get(&res.Count, countQuery+searchCondition, params...)
-	if err != nil {
-		c.Logger().Errorf("searchChairs DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	var more bool
+	res.Count, res.Chairs, more = chairSearchIndex.Search(q, p)
+	if more && len(res.Chairs) > 0 && p.Order.cursorable() {
+		res.NextCursor = p.Order.cursor(&res.Chairs[len(res.Chairs)-1])
 	}
-
-	chairs := []Chair{}
-	params = append(params, perPage, page*perPage)
-	err = chairDb.Select(&chairs, searchQuery+searchCondition+limitOffset, params...)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, ChairSearchResponse{Count: 0, Chairs: []Chair{}})
-		}
-		c.Logger().Errorf("searchChairs DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	if facets != nil {
+		counts := chairSearchIndex.Facets(q, facets)
+		res.Facets = &counts
 	}
 
-	res.Chairs = chairs
-
 	return c.JSON(http.StatusOK, res)
 }
 
@@ -677,7 +781,7 @@ func buyChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	_, ok := m["email"].(string)
+	email, ok := m["email"].(string)
 	if !ok {
 		c.Echo().Logger.Info("post buy chair failed : email not found in request body")
 		return c.NoContent(http.StatusBadRequest)
@@ -689,15 +793,17 @@ func buyChair(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	tx, err := chairDb.Beginx()
+	if token, ok := m["token"].(string); ok {
+		return buyReservedChair(c, id, email, token)
+	}
+
+	quantity, err := parseQuantity(m)
 	if err != nil {
-		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		c.Echo().Logger.Infof("post buy chair failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
-	defer tx.Rollback()
 
-	var chair Chair
-	err = tx.QueryRowx("SELECT * FROM chair WHERE id = ? AND `in_stock` = 1 FOR UPDATE", id).StructScan(&chair)
+	chair, err := chairDetailCache.Get(context.Background(), id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
@@ -707,20 +813,35 @@ func buyChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	_, err = tx.Exec("UPDATE chair SET stock = stock - 1 WHERE id = ?", id)
-	if err != nil {
-		c.Echo().Logger.Errorf("chair stock update failed : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	before, ok := chairStockLedger.Take(chair.ID, quantity)
+	if !ok {
+		if before <= 0 {
+			c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Echo().Logger.Infof("buyChair chair id \"%v\" has only %v in stock", id, before)
+		return c.NoContent(http.StatusConflict)
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		c.Echo().Logger.Errorf("transaction commit error : %v", err)
+	if err := func() error {
+		tx, err := chairDb.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := insertChairOrder(tx, chair, email, quantity, nil); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}(); err != nil {
+		chairStockLedger.Put(chair.ID, quantity)
+		c.Echo().Logger.Errorf("chair order insert failed : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	chairDetailCache.Forget(id)
-	lowPricedChairCache.Purge()
+	applyChairStock(chair.ID)
+	// 在庫は台帳から返すので詳細のキャッシュは捨てなくてよいが、キャッシュが切れた場合もプライマリから読ませる
+	chairReplicas.markWritten(chair.ID)
 
 	return c.NoContent(http.StatusOK)
 }
@@ -788,166 +909,78 @@ func postEstate(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
+	mode, err := parseImportMode(c.FormValue("mode"))
 	if err != nil {
-		c.Logger().Errorf("failed to read csv: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		c.Logger().Infof("invalid import mode : %v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
-
-	estates := make([]Estate, 0, len(records))
-	for _, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		address := rm.NextString()
-		latitude := rm.NextFloat()
-		longitude := rm.NextFloat()
-		rent := rm.NextInt()
-		doorHeight := rm.NextInt()
-		doorWidth := rm.NextInt()
-		features := rm.NextString()
-		popularity := rm.NextInt()
-		if err := rm.Err(); err != nil {
-			c.Logger().Errorf("failed to read record: %v", err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-		estates = append(estates, Estate{
-			ID:          int64(id),
-			Thumbnail:   thumbnail,
-			Name:        name,
-			Description: description,
-			Latitude:    latitude,
-			Longitude:   longitude,
-			Address:     address,
-			Rent:        int64(rent),
-			DoorHeight:  int64(doorHeight),
-			DoorWidth:   int64(doorWidth),
-			Features:    features,
-			Popularity:  int64(popularity),
-		})
-	}
-	if _, err := estateDb.NamedExec("INSERT INTO `estate` (id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity) VALUES (:id, :name, :description, :thumbnail, :address, :latitude, :longitude, :rent, :door_height, :door_width, :features, :popularity)", estates); err != nil {
-		c.Logger().Errorf("failed to insert estate: %v", err)
+	dryRun := c.FormValue("dryRun") == "true"
+	report, imported, err := importCSV(estateDb, f, estateImportTarget, mode, dryRun)
+	if err != nil {
+		c.Logger().Errorf("failed to import estate: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	if dryRun {
+		return c.JSON(http.StatusOK, report)
+	}
 
+	estates := imported.All
+	estateNazotteIndex.Add(estates)
+	forgetRecommendedEstates(estateRecommendIndex.Add(estates))
+	addEstateSuggestions(estates)
+	ids := make([]int64, 0, len(estates))
+	for _, estate := range estates {
+		ids = append(ids, estate.ID)
+		estateDetailCache.Forget(int(estate.ID))
+	}
+	estateReplicas.markWritten(ids...)
+	publishWebhookEvents(webhookEstateAdded, imported.Inserted)
 	lowPricedEstateCache.Purge()
+	recordEstateMatches(estates)
 
-	return c.NoContent(http.StatusCreated)
+	return c.JSON(http.StatusCreated, report)
 }
 
 func searchEstates(c echo.Context) error {
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
-
-	if c.QueryParam("doorHeightRangeId") != "" {
-		// doorHeight, err := getRange(estateSearchCondition.DoorHeight, c.QueryParam("doorHeightRangeId"))
-		// if err != nil {
-		// 	c.Echo().Logger.Infof("doorHeightRangeID invalid, %v : %v", c.QueryParam("doorHeightRangeId"), err)
-		// 	return c.NoContent(http.StatusBadRequest)
-		// }
-
-		// if doorHeight.Min != -1 {
-		// 	conditions = append(conditions, "door_height >= ?")
-		// 	params = append(params, doorHeight.Min)
-		// }
-		// if doorHeight.Max != -1 {
-		// 	conditions = append(conditions, "door_height < ?")
-		// 	params = append(params, doorHeight.Max)
-		// }
-		rangeIndex, err := strconv.Atoi(c.QueryParam("doorHeightRangeId"))
-		if err != nil && !(0 <= rangeIndex && rangeIndex <= 3) {
-			return c.NoContent(http.StatusBadRequest)
-		}
-		conditions = append(conditions, "door_height_range="+strconv.Itoa(rangeIndex))
-	}
-
-	if c.QueryParam("doorWidthRangeId") != "" {
-		// doorWidth, err := getRange(estateSearchCondition.DoorWidth, c.QueryParam("doorWidthRangeId"))
-		// if err != nil {
-		// 	c.Echo().Logger.Infof("doorWidthRangeID invalid, %v : %v", c.QueryParam("doorWidthRangeId"), err)
-		// 	return c.NoContent(http.StatusBadRequest)
-		// }
-
-		// if doorWidth.Min != -1 {
-		// 	conditions = append(conditions, "door_width >= ?")
-		// 	params = append(params, doorWidth.Min)
-		// }
-		// if doorWidth.Max != -1 {
-		// 	conditions = append(conditions, "door_width < ?")
-		// 	params = append(params, doorWidth.Max)
-		// }
-		rangeIndex, err := strconv.Atoi(c.QueryParam("doorWidthRangeId"))
-		if err != nil && !(0 <= rangeIndex && rangeIndex <= 3) {
-			return c.NoContent(http.StatusBadRequest)
-		}
-		conditions = append(conditions, "door_width_range="+strconv.Itoa(rangeIndex))
-	}
-
-	if c.QueryParam("rentRangeId") != "" {
-		// estateRent, err := getRange(estateSearchCondition.Rent, c.QueryParam("rentRangeId"))
-		// if err != nil {
-		// 	c.Echo().Logger.Infof("rentRangeID invalid, %v : %v", c.QueryParam("rentRangeId"), err)
-		// 	return c.NoContent(http.StatusBadRequest)
-		// }
-		//
-		// if estateRent.Min != -1 {
-		// 	conditions = append(conditions, "rent >= ?")
-		// 	params = append(params, estateRent.Min)
-		// }
-		// if estateRent.Max != -1 {
-		// 	conditions = append(conditions, "rent < ?")
-		// 	params = append(params, estateRent.Max)
-		// }
-
-		rangeIndex, err := strconv.Atoi(c.QueryParam("rentRangeId"))
-		if err != nil && !(0 <= rangeIndex && rangeIndex <= 3) {
-			return c.NoContent(http.StatusBadRequest)
-		}
-		conditions = append(conditions, "rent_range="+strconv.Itoa(rangeIndex))
-	}
-
-	if c.QueryParam("features") != "" {
-		for _, f := range strings.Split(c.QueryParam("features"), ",") {
-			conditions = append(conditions, "features like concat('%', ?, '%')")
-			params = append(params, f)
-		}
-	}
-
-	if len(conditions) == 0 {
-		c.Echo().Logger.Infof("searchEstates search condition not found")
-		return c.NoContent(http.StatusBadRequest)
-	}
-
-	page, err := strconv.Atoi(c.QueryParam("page"))
+	q, p, err := parseSearchParams(c.QueryParams(), parseEstateSearchQuery, estateSortOrders)
 	if err != nil {
-		c.Logger().Infof("Invalid format page parameter : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return badSearchRequest(c, err)
 	}
-
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	facets, err := parseFacets(c.QueryParams(), estateFacetNames)
 	if err != nil {
-		c.Logger().Infof("Invalid format perPage parameter : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return badSearchRequest(c, err)
 	}
+	conditions, params := q.conditions()
 
 	searchQuery := "SELECT * FROM estate WHERE "
 	countQuery := "SELECT COUNT(*) FROM estate WHERE "
 	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity_m ASC, id ASC LIMIT ? OFFSET ?"
+	limitOffset := p.Order.orderBy() + " LIMIT ? OFFSET ?"
+	var selectParams []interface{}
+	if q.Text != nil {
+		searchQuery = "SELECT *, " + textMatchSQL + " AS relevance FROM estate WHERE "
+		selectParams = append(selectParams, q.Text.against())
+	}
 
+	// 件数と一覧で同じレプリカを読む
+	db := estateReplicas.reader()
 	var res EstateSearchResponse
-	err = estateDb.Get(&res.Count, countQuery+searchCondition, params...)
+	err = db.Get(&res.Count, countQuery+searchCondition, params...)
 	if err != nil {
 		c.Logger().Errorf("searchEstates DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	// 次のページがあるかを知るために1件多く読む
+	if p.Cursor != nil {
+		// 並び順の列と id のインデックスの範囲で cursor の位置から読み始める
+		cond, cursorParams := p.Order.cursorCondition(p.Cursor)
+		searchCondition += " AND " + cond
+		params = append(params, cursorParams...)
+	}
 	estates := []Estate{}
-	params = append(params, perPage, page*perPage)
-	err = estateDb.Select(&estates, searchQuery+searchCondition+limitOffset, params...)
+	params = append(append(selectParams, params...), p.PerPage+1, p.offset())
+	err = db.Select(&estates, searchQuery+searchCondition+limitOffset, params...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.JSON(http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
@@ -956,8 +989,23 @@ func searchEstates(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	if len(estates) > p.PerPage {
+		estates = estates[:p.PerPage]
+		if len(estates) > 0 && p.Order.cursorable() {
+			res.NextCursor = p.Order.cursor(&estates[len(estates)-1])
+		}
+	}
 	res.Estates = estates
 
+	if facets != nil {
+		counts, err := estateFacetCounts(db, q, facets)
+		if err != nil {
+			c.Logger().Errorf("searchEstates DB execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		res.Facets = &counts
+	}
+
 	return c.JSON(http.StatusOK, res)
 }
 
@@ -982,9 +1030,7 @@ func searchRecommendedEstateWithChair(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	chair := Chair{}
-	query := `SELECT * FROM chair WHERE id = ?`
-	err = chairDb.Get(&chair, query, id)
+	chair, err := chairDetailCache.Get(context.Background(), id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			c.Logger().Infof("Requested chair id \"%v\" not found", id)
@@ -994,21 +1040,72 @@ func searchRecommendedEstateWithChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	var estates []Estate
-	w := chair.Width
-	h := chair.Height
-	d := chair.Depth
-	query = `SELECT * FROM estate WHERE (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) ORDER BY popularity_m ASC, id ASC LIMIT ?`
-	err = estateDb.Select(&estates, query, w, h, w, d, h, w, h, d, d, w, d, h, Limit)
+	estates, err := recommendedEstateCache.Get(context.Background(), footprintOf(chair))
+	if err != nil {
+		c.Logger().Errorf("searchRecommendedEstateWithChair error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
+}
+
+// searchRecommendedChairWithEstate 物件の扉を通る在庫のある椅子を人気順に返す。
+// searchChairs と同じ条件で絞り込めるが、条件は省略してよく、ページの指定がなければ先頭の Limit 件を返す
+func searchRecommendedChairWithEstate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("estateId"))
+	if err != nil {
+		c.Logger().Infof("Invalid format searchRecommendedChairWithEstate id : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	params := url.Values{}
+	for k, v := range c.QueryParams() {
+		params[k] = v
+	}
+	if params.Get("cursor") == "" && params.Get("page") == "" {
+		params.Set("page", "0")
+	}
+	if params.Get("perPage") == "" {
+		params.Set("perPage", strconv.Itoa(Limit))
+	}
+	q, err := parseChairSearchQuery(params)
+	if err != nil {
+		return badSearchRequest(c, err)
+	}
+	p, err := parseSearchPage(params, chairSortOrders)
+	if err != nil {
+		return badSearchRequest(c, err)
+	}
+	if p.Order.relevance && q.Text == nil {
+		return badSearchRequest(c, invalidSearchParam("sort", "relevance requires q"))
+	}
+
+	estate, err := estateDetailCache.Get(context.Background(), id)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, EstateListResponse{[]Estate{}})
+			c.Logger().Infof("Requested estate id \"%v\" not found", id)
+			return c.NoContent(http.StatusNotFound)
 		}
 		c.Logger().Errorf("Database execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
+	if q.Text != nil {
+		if err := q.Text.loadScores(chairReplicas.reader()); err != nil {
+			c.Logger().Errorf("searchRecommendedChairWithEstate DB execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	var res ChairSearchResponse
+	var more bool
+	door := doorSize{width: estate.DoorWidth, height: estate.DoorHeight}
+	res.Count, res.Chairs, more = chairSearchIndex.Fitting(door, q, p)
+	if more && len(res.Chairs) > 0 && p.Order.cursorable() {
+		res.NextCursor = p.Order.cursor(&res.Chairs[len(res.Chairs)-1])
+	}
+
+	return c.JSON(http.StatusOK, res)
 }
 
 func searchEstateNazotte(c echo.Context) error {
@@ -1022,18 +1119,13 @@ func searchEstateNazotte(c echo.Context) error {
 	if len(coordinates.Coordinates) == 0 {
 		return c.NoContent(http.StatusBadRequest)
 	}
-
-	estates := []Estate{}
-	query := fmt.Sprintf(`SELECT * FROM estate WHERE ST_Contains(ST_PolygonFromText(%s), point) ORDER BY popularity_m ASC, id ASC LIMIT ?`, coordinates.coordinatesToText())
-	err = estateDb.Select(&estates, query, NazotteLimit)
-	if err == sql.ErrNoRows {
-		c.Echo().Logger.Infof("select * from estate where latitude ...", err)
-		return c.JSON(http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
-	} else if err != nil {
-		c.Echo().Logger.Errorf("database execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	if !coordinates.valid() {
+		c.Echo().Logger.Info("post search estate nazotte failed : coordinates out of range")
+		return c.NoContent(http.StatusBadRequest)
 	}
 
+	estates := estateNazotteIndex.Search(coordinates, NazotteLimit)
+
 	var re EstateSearchResponse
 	re.Estates = estates
 	re.Count = int64(len(re.Estates))
@@ -1048,12 +1140,14 @@ func postEstateRequestDocument(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	_, ok := m["email"].(string)
+	email, ok := m["email"].(string)
 	if !ok {
 		c.Echo().Logger.Info("post request document failed : email not found in request body")
 		return c.NoContent(http.StatusBadRequest)
 	}
 
+	message, _ := m["message"].(string)
+
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.Echo().Logger.Infof("post request document failed : %v", err)
@@ -1069,6 +1163,16 @@ func postEstateRequestDocument(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	if !documentRequestLimiter.Allow(email) {
+		c.Echo().Logger.Infof("post request document failed : too many requests from %v", email)
+		return c.NoContent(http.StatusTooManyRequests)
+	}
+
+	if _, err := insertEstateDocumentRequest(int64(id), email, message); err != nil {
+		c.Logger().Errorf("postEstateRequestDocument DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -1103,11 +1207,3 @@ func (cs Coordinates) getBoundingBox() BoundingBox {
 	}
 	return boundingBox
 }
-
-func (cs Coordinates) coordinatesToText() string {
-	points := make([]string, 0, len(cs.Coordinates))
-	for _, c := range cs.Coordinates {
-		points = append(points, fmt.Sprintf("%f %f", c.Latitude, c.Longitude))
-	}
-	return fmt.Sprintf("'POLYGON((%s))'", strings.Join(points, ","))
-}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// geoCellSize グリッドの1セルあたりの緯度経度の幅
+const geoCellSize = 0.1
+
+type geoCell struct {
+	lat int
+	lng int
+}
+
+// geoMinCell, geoMaxCell 緯度経度の取りうる範囲の端のセル。物件は入稿時にこの範囲に収まることを確かめている
+var (
+	geoMinCell = cellOf(-90, -180)
+	geoMaxCell = cellOf(90, 180)
+)
+
+func cellOf(latitude, longitude float64) geoCell {
+	return geoCell{
+		lat: int(math.Floor(latitude / geoCellSize)),
+		lng: int(math.Floor(longitude / geoCellSize)),
+	}
+}
+
+func estateLess(a, b *Estate) bool {
+	if a.PopularityM != b.PopularityM {
+		return a.PopularityM < b.PopularityM
+	}
+	return a.ID < b.ID
+}
+
+// estateGeoIndex 物件の緯度経度をグリッドに分割して保持するなぞって検索用インデックス
+type estateGeoIndex struct {
+	mu sync.RWMutex
+
+	byID  map[int64]*Estate
+	cells map[geoCell][]*Estate
+}
+
+func newEstateGeoIndex() *estateGeoIndex {
+	return &estateGeoIndex{
+		byID:  map[int64]*Estate{},
+		cells: map[geoCell][]*Estate{},
+	}
+}
+
+var estateNazotteIndex = newEstateGeoIndex()
+
+// Load estate テーブルから全物件を読み込んでインデックスを作り直す
+func (idx *estateGeoIndex) Load(db *sqlx.DB) error {
+	var estates []Estate
+	if err := db.Select(&estates, "SELECT * FROM estate"); err != nil {
+		return err
+	}
+
+	fresh := newEstateGeoIndex()
+	for i := range estates {
+		fresh.add(&estates[i])
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.byID = fresh.byID
+	idx.cells = fresh.cells
+	return nil
+}
+
+// Add 新しく登録された物件をインデックスに追加する
+func (idx *estateGeoIndex) Add(estates []Estate) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for i := range estates {
+		estate := estates[i]
+		estate.PopularityM = -estate.Popularity
+		if old, ok := idx.byID[estate.ID]; ok {
+			idx.remove(old)
+		}
+		idx.add(&estate)
+	}
+}
+
+// Search 多角形の内部にある物件を人気順に最大 limit 件返す
+func (idx *estateGeoIndex) Search(cs Coordinates, limit int) []Estate {
+	bb := cs.getBoundingBox()
+	minCell := cellOf(bb.TopLeftCorner.Latitude, bb.TopLeftCorner.Longitude)
+	maxCell := cellOf(bb.BottomRightCorner.Latitude, bb.BottomRightCorner.Longitude)
+	// 範囲外のセルには物件がないので、走査するセルを緯度経度の取りうる範囲に収める
+	if minCell.lat < geoMinCell.lat {
+		minCell.lat = geoMinCell.lat
+	}
+	if minCell.lng < geoMinCell.lng {
+		minCell.lng = geoMinCell.lng
+	}
+	if maxCell.lat > geoMaxCell.lat {
+		maxCell.lat = geoMaxCell.lat
+	}
+	if maxCell.lng > geoMaxCell.lng {
+		maxCell.lng = geoMaxCell.lng
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var candidates []*Estate
+	collect := func(estates []*Estate) {
+		for _, estate := range estates {
+			if bb.contains(estate.Latitude, estate.Longitude) && cs.contains(estate.Latitude, estate.Longitude) {
+				candidates = append(candidates, estate)
+			}
+		}
+	}
+
+	// 多角形が広い場合は存在するセルだけを走査する
+	// セル数は float64 で数えて、範囲が広くても桁あふれしないようにする
+	if float64(maxCell.lat-minCell.lat+1)*float64(maxCell.lng-minCell.lng+1) > float64(len(idx.cells)) {
+		for cell, estates := range idx.cells {
+			if minCell.lat <= cell.lat && cell.lat <= maxCell.lat && minCell.lng <= cell.lng && cell.lng <= maxCell.lng {
+				collect(estates)
+			}
+		}
+	} else {
+		for lat := minCell.lat; lat <= maxCell.lat; lat++ {
+			for lng := minCell.lng; lng <= maxCell.lng; lng++ {
+				collect(idx.cells[geoCell{lat: lat, lng: lng}])
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return estateLess(candidates[i], candidates[j]) })
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	estates := make([]Estate, 0, len(candidates))
+	for _, estate := range candidates {
+		estates = append(estates, *estate)
+	}
+	return estates
+}
+
+func (idx *estateGeoIndex) add(estate *Estate) {
+	idx.byID[estate.ID] = estate
+	cell := cellOf(estate.Latitude, estate.Longitude)
+	idx.cells[cell] = append(idx.cells[cell], estate)
+}
+
+func (idx *estateGeoIndex) remove(estate *Estate) {
+	delete(idx.byID, estate.ID)
+	cell := cellOf(estate.Latitude, estate.Longitude)
+	estates := idx.cells[cell]
+	for i, e := range estates {
+		if e == estate {
+			idx.cells[cell] = append(estates[:i], estates[i+1:]...)
+			break
+		}
+	}
+}
+
+func (bb BoundingBox) contains(latitude, longitude float64) bool {
+	return bb.TopLeftCorner.Latitude <= latitude && latitude <= bb.BottomRightCorner.Latitude &&
+		bb.TopLeftCorner.Longitude <= longitude && longitude <= bb.BottomRightCorner.Longitude
+}
+
+// valid 全ての点の緯度が ±90、経度が ±180 の範囲にあるかを返す
+func (cs Coordinates) valid() bool {
+	for _, c := range cs.Coordinates {
+		if c.Latitude < -90 || 90 < c.Latitude || c.Longitude < -180 || 180 < c.Longitude {
+			return false
+		}
+	}
+	return true
+}
+
+// contains 点が多角形の内部にあるかを ray casting で判定する
+func (cs Coordinates) contains(latitude, longitude float64) bool {
+	coordinates := cs.Coordinates
+	inside := false
+	for i, j := 0, len(coordinates)-1; i < len(coordinates); j, i = i, i+1 {
+		a, b := coordinates[i], coordinates[j]
+		if (a.Longitude > longitude) != (b.Longitude > longitude) &&
+			latitude < (b.Latitude-a.Latitude)*(longitude-a.Longitude)/(b.Longitude-a.Longitude)+a.Latitude {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestEstateGeoIndexSearch(t *testing.T) {
+	idx := newEstateGeoIndex()
+	idx.Add([]Estate{
+		{ID: 1, Latitude: 35.5, Longitude: 139.5, Popularity: 10},
+		{ID: 2, Latitude: 35.6, Longitude: 139.6, Popularity: 20},
+		{ID: 3, Latitude: 40.0, Longitude: 140.0, Popularity: 30},
+	})
+	square := func(min, max float64) Coordinates {
+		return Coordinates{Coordinates: []Coordinate{
+			{Latitude: min, Longitude: min}, {Latitude: min, Longitude: max},
+			{Latitude: max, Longitude: max}, {Latitude: max, Longitude: min},
+		}}
+	}
+	tests := []struct {
+		name string
+		cs   Coordinates
+		want []int64
+	}{
+		{"small polygon", Coordinates{Coordinates: []Coordinate{
+			{Latitude: 35, Longitude: 139}, {Latitude: 35, Longitude: 140},
+			{Latitude: 36, Longitude: 140}, {Latitude: 36, Longitude: 139},
+		}}, []int64{2, 1}},
+		// 範囲外の座標でもセルの数え上げが桁あふれせず、すぐに返る
+		{"huge polygon", square(-1e9, 1e9), []int64{3, 2, 1}},
+		{"outside the world", square(1e9, 2e9), []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := []int64{}
+			for _, e := range idx.Search(tt.cs, NazotteLimit) {
+				ids = append(ids, e.ID)
+			}
+			if len(ids) != len(tt.want) {
+				t.Fatalf("Search() ids = %v, want %v", ids, tt.want)
+			}
+			for i := range ids {
+				if ids[i] != tt.want[i] {
+					t.Fatalf("Search() ids = %v, want %v", ids, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCoordinatesValid(t *testing.T) {
+	tests := []struct {
+		name string
+		c    Coordinate
+		want bool
+	}{
+		{"inside", Coordinate{Latitude: 35, Longitude: 139}, true},
+		{"corner", Coordinate{Latitude: -90, Longitude: 180}, true},
+		{"latitude too large", Coordinate{Latitude: 90.1, Longitude: 0}, false},
+		{"longitude too small", Coordinate{Latitude: 0, Longitude: -1e9}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := Coordinates{Coordinates: []Coordinate{tt.c}}
+			if got := cs.valid(); got != tt.want {
+				t.Errorf("valid(%+v) = %v, want %v", tt.c, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// ChairOrder 椅子の購入履歴
+type ChairOrder struct {
+	ID        int64     `db:"id" json:"id"`
+	ChairID   int64     `db:"chair_id" json:"chairId"`
+	Email     string    `db:"email" json:"email"`
+	Price     int64     `db:"price" json:"price"`
+	Quantity  int64     `db:"quantity" json:"quantity"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+	// ReservationID 仮押さえを確定した購入の場合はその仮押さえの id
+	ReservationID *int64 `db:"reservation_id" json:"reservationId,omitempty"`
+}
+
+type ChairOrderListResponse struct {
+	Count  int64        `json:"count"`
+	Orders []ChairOrder `json:"orders"`
+}
+
+// ChairPurchasedEvent 椅子が購入されたときに outbox に記録するイベント
+type ChairPurchasedEvent struct {
+	OrderID       int64  `json:"orderId"`
+	ChairID       int64  `json:"chairId"`
+	Email         string `json:"email"`
+	Price         int64  `json:"price"`
+	Quantity      int64  `json:"quantity"`
+	ReservationID *int64 `json:"reservationId,omitempty"`
+}
+
+// insertChairOrder 購入時点の価格で購入履歴を記録し、同じトランザクションで購入イベントを outbox に積む。
+// 在庫は台帳で減らしてあるので、ここでの記録が失敗したら呼び出し側で在庫を戻す
+func insertChairOrder(tx sqlx.Execer, chair *Chair, email string, quantity int64, reservationID *int64) (int64, error) {
+	res, err := tx.Exec("INSERT INTO chair_order (chair_id, email, price, quantity, reservation_id) VALUES (?, ?, ?, ?, ?)", chair.ID, email, chair.Price, quantity, reservationID)
+	if err != nil {
+		return 0, err
+	}
+	orderID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	event := ChairPurchasedEvent{
+		OrderID:       orderID,
+		ChairID:       chair.ID,
+		Email:         email,
+		Price:         chair.Price,
+		Quantity:      quantity,
+		ReservationID: reservationID,
+	}
+	if err := enqueueOutboxEvent(tx, "chair.purchased", event); err != nil {
+		return 0, err
+	}
+	return orderID, nil
+}
+
+// parsePagination page, perPage パラメータを読む。省略された場合は先頭の Limit 件とする。
+// 検索と同じく searchMaxPerPage より大きい perPage は切り詰める
+func parsePagination(c echo.Context) (int, int, error) {
+	page, perPage := 0, Limit
+	var err error
+	if c.QueryParam("page") != "" {
+		if page, err = strconv.Atoi(c.QueryParam("page")); err != nil {
+			return 0, 0, err
+		}
+	}
+	if c.QueryParam("perPage") != "" {
+		if perPage, err = strconv.Atoi(c.QueryParam("perPage")); err != nil {
+			return 0, 0, err
+		}
+	}
+	if page < 0 || perPage <= 0 {
+		return 0, 0, fmt.Errorf("invalid page or perPage: %d, %d", page, perPage)
+	}
+	if perPage > searchMaxPerPage {
+		perPage = searchMaxPerPage
+	}
+	return page, perPage, nil
+}
+
+func listChairOrders(c echo.Context, condition string, param interface{}) error {
+	page, perPage, err := parsePagination(c)
+	if err != nil {
+		c.Logger().Infof("Invalid format pagination parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	var res ChairOrderListResponse
+	if err := chairDb.Get(&res.Count, "SELECT COUNT(*) FROM chair_order WHERE "+condition, param); err != nil {
+		c.Logger().Errorf("listChairOrders DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res.Orders = []ChairOrder{}
+	query := "SELECT * FROM chair_order WHERE " + condition + " ORDER BY id DESC LIMIT ? OFFSET ?"
+	if err := chairDb.Select(&res.Orders, query, param, perPage, page*perPage); err != nil {
+		c.Logger().Errorf("listChairOrders DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func getOrdersByEmail(c echo.Context) error {
+	email := c.QueryParam("email")
+	if email == "" {
+		c.Echo().Logger.Info("get orders failed : email not found in query")
+		return c.NoContent(http.StatusBadRequest)
+	}
+	return listChairOrders(c, "email = ?", email)
+}
+
+func getChairOrders(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	return listChairOrders(c, "chair_id = ?", id)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	outboxFailed    = "failed"
+
+	// outboxMaxAttempts これだけ配送に失敗したイベントは failed にして諦める
+	outboxMaxAttempts = 10
+	outboxBaseBackoff = time.Second
+	outboxMaxBackoff  = 5 * time.Minute
+	outboxBatchSize   = 100
+)
+
+// OutboxEvent 業務データの変更と同じトランザクションで記録し、後から外部に配送するイベント
+type OutboxEvent struct {
+	ID            int64     `db:"id" json:"id"`
+	EventType     string    `db:"event_type" json:"eventType"`
+	Payload       string    `db:"payload" json:"payload"`
+	Status        string    `db:"status" json:"status"`
+	Attempts      int       `db:"attempts" json:"attempts"`
+	NextAttemptAt time.Time `db:"next_attempt_at" json:"nextAttemptAt"`
+	LastError     string    `db:"last_error" json:"lastError"`
+	CreatedAt     time.Time `db:"created_at" json:"createdAt"`
+}
+
+// outboxMessage 配送先に送るイベントの形式
+type outboxMessage struct {
+	ID        int64           `json:"id"`
+	EventType string          `json:"eventType"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+func (e OutboxEvent) message() ([]byte, error) {
+	return json.Marshal(outboxMessage{
+		ID:        e.ID,
+		EventType: e.EventType,
+		Payload:   json.RawMessage(e.Payload),
+		CreatedAt: e.CreatedAt,
+	})
+}
+
+// enqueueOutboxEvent イベントを outbox に記録する。業務データを書き込むトランザクションの中で呼ぶ
+func enqueueOutboxEvent(tx sqlx.Execer, eventType string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO outbox_event (event_type, payload, status, next_attempt_at) VALUES (?, ?, ?, ?)", eventType, string(b), outboxPending, time.Now())
+	return err
+}
+
+// outboxSink イベントの配送先
+type outboxSink interface {
+	Deliver(ctx context.Context, event OutboxEvent) error
+}
+
+// httpOutboxSink イベントを JSON で POST する。2xx 以外は失敗として扱う
+type httpOutboxSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpOutboxSink) Deliver(ctx context.Context, event OutboxEvent) error {
+	body, err := event.message()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || 300 <= res.StatusCode {
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return nil
+}
+
+// fileOutboxSink イベントを1行1件の JSON としてファイルに追記する
+type fileOutboxSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (s *fileOutboxSink) Deliver(_ context.Context, event OutboxEvent) error {
+	b, err := event.message()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// stdoutOutboxSink イベントを標準出力に書き出す
+type stdoutOutboxSink struct{}
+
+func (stdoutOutboxSink) Deliver(_ context.Context, event OutboxEvent) error {
+	b, err := event.message()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(b))
+	return err
+}
+
+// newOutboxSink OUTBOX_SINK の値から配送先を作る。
+// "stdout", "file:/path/to/file", "http://..." または "https://..." を受け付ける
+func newOutboxSink(spec string) (outboxSink, error) {
+	switch {
+	case spec == "stdout":
+		return stdoutOutboxSink{}, nil
+	case strings.HasPrefix(spec, "file:"):
+		return &fileOutboxSink{path: strings.TrimPrefix(spec, "file:")}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &httpOutboxSink{url: spec, client: &http.Client{Timeout: 5 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("unknown outbox sink: %v", spec)
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	d := outboxBaseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= outboxMaxBackoff {
+			return outboxMaxBackoff
+		}
+	}
+	return d
+}
+
+// outboxDispatcher 1つの DB の outbox を読んで配送する
+type outboxDispatcher struct {
+	db   *sqlx.DB
+	sink outboxSink
+}
+
+// dispatch 配送期限の来たイベントを配送し、失敗したものは間隔を空けて再送する
+func (d *outboxDispatcher) dispatch() error {
+	var events []OutboxEvent
+	query := "SELECT * FROM outbox_event WHERE status = ? AND next_attempt_at <= ? ORDER BY id ASC LIMIT ?"
+	if err := d.db.Select(&events, query, outboxPending, time.Now(), outboxBatchSize); err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := d.sink.Deliver(ctx, event)
+		cancel()
+		if err == nil {
+			if _, err := d.db.Exec("UPDATE outbox_event SET status = ?, attempts = attempts + 1, last_error = '' WHERE id = ?", outboxDelivered, event.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		attempts := event.Attempts + 1
+		status := outboxPending
+		if attempts >= outboxMaxAttempts {
+			status = outboxFailed
+		}
+		lastError := err.Error()
+		if len(lastError) > 1024 {
+			lastError = lastError[:1024]
+		}
+		if _, err := d.db.Exec("UPDATE outbox_event SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
+			status, attempts, time.Now().Add(outboxBackoff(attempts)), lastError, event.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *outboxDispatcher) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := d.dispatch(); err != nil {
+			log.Errorf("failed to dispatch outbox events : %v", err)
+		}
+	}
+}
+
+// OutboxSummary 1つの DB の outbox の状況
+type OutboxSummary struct {
+	Pending int64         `json:"pending"`
+	Failed  int64         `json:"failed"`
+	Events  []OutboxEvent `json:"events"`
+}
+
+type OutboxStatusResponse struct {
+	Chair  OutboxSummary `json:"chair"`
+	Estate OutboxSummary `json:"estate"`
+}
+
+func summarizeOutbox(db *sqlx.DB, limit int) (OutboxSummary, error) {
+	var s OutboxSummary
+	if err := db.Get(&s.Pending, "SELECT COUNT(*) FROM outbox_event WHERE status = ?", outboxPending); err != nil {
+		return s, err
+	}
+	if err := db.Get(&s.Failed, "SELECT COUNT(*) FROM outbox_event WHERE status = ?", outboxFailed); err != nil {
+		return s, err
+	}
+	s.Events = []OutboxEvent{}
+	query := "SELECT * FROM outbox_event WHERE status IN (?, ?) ORDER BY id ASC LIMIT ?"
+	if err := db.Select(&s.Events, query, outboxPending, outboxFailed, limit); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// getOutboxStatus 未配送と配送に失敗したイベントを返す
+func getOutboxStatus(c echo.Context) error {
+	var res OutboxStatusResponse
+	var err error
+	if res.Chair, err = summarizeOutbox(chairDb, Limit); err != nil {
+		c.Logger().Errorf("getOutboxStatus DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if res.Estate, err = summarizeOutbox(estateDb, Limit); err != nil {
+		c.Logger().Errorf("getOutboxStatus DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+var (
+	// readYourWritesWindow 書き込んだ行をこの間はプライマリから読み、レプリカの遅延で古い値を返さないようにする
+	readYourWritesWindow = 3 * time.Second
+	// replicaMaxLag これより遅れているレプリカには読み込みを振り分けない
+	replicaMaxLag = 5 * time.Second
+	// replicaTimeout レプリカへの接続と読み書きの時間の上限。
+	// 応答しないレプリカで起動時の確認や読み込みが OS の TCP のタイムアウトまで止まらないようにする
+	replicaTimeout = 2 * time.Second
+
+	chairReplicas  *replicaSet
+	estateReplicas *replicaSet
+)
+
+// parseReplicaHosts MYSQL_CHAIR_REPLICAS のようなカンマ区切りのホストの一覧を読む
+func parseReplicaHosts(v string) []string {
+	hosts := []string{}
+	for _, h := range strings.Split(v, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// replica 読み込み専用の接続先。healthy は定期的な確認で更新する
+type replica struct {
+	host string
+	db   *sqlx.DB
+
+	mu      sync.RWMutex
+	healthy bool
+	lag     *int64
+	err     string
+}
+
+// ReplicaStatus レプリカの状態。lagSeconds はレプリケーションが止まっている場合 null になる
+type ReplicaStatus struct {
+	Host       string `json:"host"`
+	Healthy    bool   `json:"healthy"`
+	LagSeconds *int64 `json:"lagSeconds"`
+	Error      string `json:"error,omitempty"`
+}
+
+// replicaSet プライマリとそのレプリカ。検索のような読み込みは正常なレプリカに順番に振り分ける
+type replicaSet struct {
+	primary  *sqlx.DB
+	replicas []*replica
+	next     uint32
+
+	mu      sync.Mutex
+	written map[int64]time.Time
+}
+
+// newReplicaSet conn.Replicas の各ホストに primary と同じ設定で接続する。ホストは "host" か "host:port" で指定する
+func newReplicaSet(primary *sqlx.DB, conn *MySQLConnectionEnv) (*replicaSet, error) {
+	rs := &replicaSet{primary: primary, written: map[int64]time.Time{}}
+	for _, host := range conn.Replicas {
+		env := *conn
+		env.Host = host
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			env.Host, env.Port = h, p
+		}
+		dsn := fmt.Sprintf("%s&timeout=%s&readTimeout=%s&writeTimeout=%s", env.dsn(), replicaTimeout, replicaTimeout, replicaTimeout)
+		db, err := sqlx.Open("mysql", dsn)
+		if err != nil {
+			return nil, fmt.Errorf("replica %v : %w", host, err)
+		}
+		db.SetMaxOpenConns(50)
+		rs.replicas = append(rs.replicas, &replica{host: host, db: db})
+	}
+	return rs, nil
+}
+
+func (rs *replicaSet) Close() {
+	for _, r := range rs.replicas {
+		r.db.Close()
+	}
+}
+
+// reader 正常なレプリカを順番に返す。正常なレプリカがなければプライマリを返す
+func (rs *replicaSet) reader() *sqlx.DB {
+	n := len(rs.replicas)
+	if n == 0 {
+		return rs.primary
+	}
+	start := int(atomic.AddUint32(&rs.next, 1))
+	for i := 0; i < n; i++ {
+		r := rs.replicas[(start+i)%n]
+		r.mu.RLock()
+		healthy := r.healthy
+		r.mu.RUnlock()
+		if healthy {
+			return r.db
+		}
+	}
+	return rs.primary
+}
+
+// readerFor id の行を読む接続先を返す。readYourWritesWindow 以内に書き込んだ行はプライマリから読む
+func (rs *replicaSet) readerFor(id int64) *sqlx.DB {
+	if len(rs.replicas) == 0 {
+		return rs.primary
+	}
+	rs.mu.Lock()
+	at, ok := rs.written[id]
+	rs.mu.Unlock()
+	if ok && time.Since(at) < readYourWritesWindow {
+		return rs.primary
+	}
+	return rs.reader()
+}
+
+// markWritten ids の行をプライマリに書き込んだことを記録する
+func (rs *replicaSet) markWritten(ids ...int64) {
+	if len(rs.replicas) == 0 {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := time.Now()
+	for _, id := range ids {
+		rs.written[id] = now
+	}
+}
+
+// sweepWritten readYourWritesWindow を過ぎた書き込みの記録を捨てる
+func (rs *replicaSet) sweepWritten() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := time.Now()
+	for id, at := range rs.written {
+		if now.Sub(at) >= readYourWritesWindow {
+			delete(rs.written, id)
+		}
+	}
+}
+
+// replicationLag SHOW SLAVE STATUS の Seconds_Behind_Master を読む。レプリケーションが止まっている場合は nil を返す
+func replicationLag(db *sqlx.DB) (*int64, error) {
+	rows, err := db.Queryx("SHOW SLAVE STATUS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("not a replica")
+	}
+	status := map[string]interface{}{}
+	if err := rows.MapScan(status); err != nil {
+		return nil, err
+	}
+	v, ok := status["Seconds_Behind_Master"].([]byte)
+	if !ok {
+		return nil, nil
+	}
+	lag, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &lag, nil
+}
+
+// check 各レプリカに接続できて遅延が replicaMaxLag 以内かを確かめる
+func (rs *replicaSet) check() {
+	for _, r := range rs.replicas {
+		lag, err := replicationLag(r.db)
+		healthy := err == nil && lag != nil && time.Duration(*lag)*time.Second <= replicaMaxLag
+		msg := ""
+		switch {
+		case err != nil:
+			msg = err.Error()
+		case lag == nil:
+			msg = "replication is not running"
+		case !healthy:
+			msg = fmt.Sprintf("lag %ds exceeds %v", *lag, replicaMaxLag)
+		}
+
+		r.mu.Lock()
+		if r.healthy && !healthy {
+			log.Errorf("replica %v is unhealthy : %v", r.host, msg)
+		}
+		r.healthy, r.lag, r.err = healthy, lag, msg
+		r.mu.Unlock()
+	}
+}
+
+// run interval ごとにレプリカを確認し、古い書き込みの記録が溜まり続けないように掃除する
+func (rs *replicaSet) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		rs.check()
+		rs.sweepWritten()
+	}
+}
+
+func (rs *replicaSet) status() []ReplicaStatus {
+	statuses := make([]ReplicaStatus, 0, len(rs.replicas))
+	for _, r := range rs.replicas {
+		r.mu.RLock()
+		statuses = append(statuses, ReplicaStatus{Host: r.host, Healthy: r.healthy, LagSeconds: r.lag, Error: r.err})
+		r.mu.RUnlock()
+	}
+	return statuses
+}
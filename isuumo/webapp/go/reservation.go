@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// chairReservationTTL 在庫を仮押さえしておく時間
+var chairReservationTTL = 10 * time.Minute
+
+// ChairReservation 購入前に仮押さえした椅子の在庫
+type ChairReservation struct {
+	ID        int64     `db:"id" json:"-"`
+	Token     string    `db:"token" json:"token"`
+	ChairID   int64     `db:"chair_id" json:"chairId"`
+	Email     string    `db:"email" json:"email"`
+	Quantity  int64     `db:"quantity" json:"quantity"`
+	ExpiresAt time.Time `db:"expires_at" json:"expiresAt"`
+	Status    string    `db:"status" json:"-"`
+}
+
+const (
+	reservationHeld     = "held"
+	reservationBought   = "bought"
+	reservationReleased = "released"
+)
+
+// parseQuantity リクエストボディの quantity を読む。省略された場合は1とする
+func parseQuantity(m echo.Map) (int64, error) {
+	v, ok := m["quantity"]
+	if !ok {
+		return 1, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f < 1 || f != float64(int64(f)) {
+		return 0, fmt.Errorf("invalid quantity: %v", v)
+	}
+	return int64(f), nil
+}
+
+// newRandomToken 推測できないランダムな文字列を作る
+func newRandomToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func reserveChair(c echo.Context) error {
+	m := echo.Map{}
+	if err := c.Bind(&m); err != nil {
+		c.Echo().Logger.Infof("post reserve chair failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	email, ok := m["email"].(string)
+	if !ok {
+		c.Echo().Logger.Info("post reserve chair failed : email not found in request body")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	quantity, err := parseQuantity(m)
+	if err != nil {
+		c.Echo().Logger.Infof("post reserve chair failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("post reserve chair failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	token, err := newRandomToken()
+	if err != nil {
+		c.Echo().Logger.Errorf("failed to generate reservation token : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	chair, err := chairDetailCache.Get(context.Background(), id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("reserveChair chair id \"%v\" not found", id)
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Echo().Logger.Errorf("DB Execution Error: on getting a chair by id : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 仮押さえした分は台帳の在庫から引いておき、期限切れになったら戻す
+	before, ok := chairStockLedger.Hold(chair.ID, quantity)
+	if !ok {
+		if before <= 0 {
+			c.Echo().Logger.Infof("reserveChair chair id \"%v\" not found", id)
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Echo().Logger.Infof("reserveChair chair id \"%v\" has only %v in stock", id, before)
+		return c.NoContent(http.StatusConflict)
+	}
+
+	reservation := ChairReservation{
+		Token:     token,
+		ChairID:   chair.ID,
+		Email:     email,
+		Quantity:  quantity,
+		ExpiresAt: time.Now().Add(chairReservationTTL),
+		Status:    reservationHeld,
+	}
+	if _, err := chairDb.NamedExec("INSERT INTO chair_reservation (token, chair_id, email, quantity, expires_at, status) VALUES (:token, :chair_id, :email, :quantity, :expires_at, :status)", reservation); err != nil {
+		chairStockLedger.Release(chair.ID, quantity)
+		c.Echo().Logger.Errorf("chair reservation insert failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	applyChairStock(chair.ID)
+
+	return c.JSON(http.StatusCreated, reservation)
+}
+
+// buyReservedChair 仮押さえを確定して購入履歴を記録する
+func buyReservedChair(c echo.Context, id int, email string, token string) error {
+	tx, err := chairDb.Beginx()
+	if err != nil {
+		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var reservation ChairReservation
+	err = tx.Get(&reservation, "SELECT * FROM chair_reservation WHERE token = ? AND chair_id = ? AND status = ? AND expires_at > ? FOR UPDATE", token, id, reservationHeld, time.Now())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("buyChair reservation \"%v\" not found", token)
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Echo().Logger.Errorf("DB Execution Error: on getting a reservation : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if reservation.Email != email {
+		c.Echo().Logger.Infof("buyChair reservation \"%v\" belongs to another email", token)
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	chair, err := chairDetailCache.Get(context.Background(), id)
+	if err != nil {
+		c.Echo().Logger.Errorf("DB Execution Error: on getting a chair by id : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// 在庫は仮押さえの時点で引いてあるので、状態を変えて購入履歴を残すだけでよい
+	if _, err := tx.Exec("UPDATE chair_reservation SET status = ? WHERE token = ?", reservationBought, token); err != nil {
+		c.Echo().Logger.Errorf("chair reservation update failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if _, err := insertChairOrder(tx, chair, email, reservation.Quantity, &reservation.ID); err != nil {
+		c.Echo().Logger.Errorf("chair order insert failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Echo().Logger.Errorf("transaction commit error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	chairStockLedger.Settle(chair.ID, reservation.Quantity)
+	chairReplicas.markWritten(chair.ID)
+
+	return c.NoContent(http.StatusOK)
+}
+
+// releaseExpiredChairReservations 期限切れの仮押さえを解放して台帳に在庫を戻す
+func releaseExpiredChairReservations() error {
+	tx, err := chairDb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var reservations []ChairReservation
+	if err := tx.Select(&reservations, "SELECT * FROM chair_reservation WHERE status = ? AND expires_at <= ? FOR UPDATE", reservationHeld, time.Now()); err != nil {
+		return err
+	}
+	if len(reservations) == 0 {
+		return nil
+	}
+
+	for _, r := range reservations {
+		if _, err := tx.Exec("UPDATE chair_reservation SET status = ? WHERE token = ?", reservationReleased, r.Token); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, r := range reservations {
+		chairStockLedger.Release(r.ChairID, r.Quantity)
+		applyChairStock(r.ChairID)
+	}
+	return nil
+}
+
+// runChairReservationReaper interval ごとに期限切れの仮押さえを解放する
+func runChairReservationReaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := releaseExpiredChairReservations(); err != nil {
+			log.Errorf("failed to release expired chair reservations : %v", err)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	savedSearchChair   = "chair"
+	savedSearchEstate  = "estate"
+	savedSearchNazotte = "nazotte"
+)
+
+// SavedSearch 保存された検索条件。
+// chair と estate はクエリパラメータを、nazotte は多角形の座標を JSON で query に持つ。
+// 椅子と物件のどちらも扱うので、webhook と同じく chairDb にまとめて置く
+type SavedSearch struct {
+	ID        int64     `db:"id" json:"id"`
+	Email     string    `db:"email" json:"email"`
+	Target    string    `db:"target" json:"target"`
+	Query     string    `db:"query" json:"query"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+// SavedSearchMatch 保存された検索条件に新しく入稿された椅子または物件が一致した記録
+type SavedSearchMatch struct {
+	ID            int64     `db:"id" json:"id"`
+	SavedSearchID int64     `db:"saved_search_id" json:"savedSearchId"`
+	ItemID        int64     `db:"item_id" json:"itemId"`
+	CreatedAt     time.Time `db:"created_at" json:"createdAt"`
+}
+
+type SavedSearchMatchListResponse struct {
+	Count   int64              `json:"count"`
+	Matches []SavedSearchMatch `json:"matches"`
+}
+
+// savedSearchMatcher 保存された検索条件を検索ハンドラと同じ条件で解釈したもの
+type savedSearchMatcher struct {
+	chair       *ChairSearchQuery
+	estate      *EstateSearchQuery
+	nazotte     *Coordinates
+	boundingBox BoundingBox
+}
+
+func (s SavedSearch) matcher() (*savedSearchMatcher, error) {
+	switch s.Target {
+	case savedSearchChair:
+		params, err := url.ParseQuery(s.Query)
+		if err != nil {
+			return nil, err
+		}
+		q, err := parseChairSearchQuery(params)
+		if err != nil {
+			return nil, err
+		}
+		if q.isEmpty() {
+			return nil, fmt.Errorf("search condition not found")
+		}
+		return &savedSearchMatcher{chair: q}, nil
+	case savedSearchEstate:
+		params, err := url.ParseQuery(s.Query)
+		if err != nil {
+			return nil, err
+		}
+		q, err := parseEstateSearchQuery(params)
+		if err != nil {
+			return nil, err
+		}
+		if q.isEmpty() {
+			return nil, fmt.Errorf("search condition not found")
+		}
+		return &savedSearchMatcher{estate: q}, nil
+	case savedSearchNazotte:
+		var cs Coordinates
+		if err := json.Unmarshal([]byte(s.Query), &cs); err != nil {
+			return nil, err
+		}
+		if len(cs.Coordinates) == 0 {
+			return nil, fmt.Errorf("coordinates not found")
+		}
+		if !cs.valid() {
+			return nil, fmt.Errorf("coordinates out of range")
+		}
+		return &savedSearchMatcher{nazotte: &cs, boundingBox: cs.getBoundingBox()}, nil
+	}
+	return nil, fmt.Errorf("unknown target: %v", s.Target)
+}
+
+// matchChair 検索と同じく在庫のない椅子は一致させない
+func (m *savedSearchMatcher) matchChair(chair *Chair) bool {
+	return m.chair != nil && chair.Stock > 0 && m.chair.match(chair)
+}
+
+func (m *savedSearchMatcher) matchEstate(estate *Estate) bool {
+	switch {
+	case m.estate != nil:
+		return m.estate.match(estate)
+	case m.nazotte != nil:
+		return m.boundingBox.contains(estate.Latitude, estate.Longitude) && m.nazotte.contains(estate.Latitude, estate.Longitude)
+	}
+	return false
+}
+
+// loadScores キーワードのある条件では、照合する行の関連度を検索と同じ FULLTEXT インデックスから引いておく。
+// 入稿した直後の行を読むのでプライマリから引く
+func (m *savedSearchMatcher) loadScores(ids []int64) error {
+	switch {
+	case m.chair != nil && m.chair.Text != nil:
+		return m.chair.Text.loadScoresOf(chairDb, "chair", ids)
+	case m.estate != nil && m.estate.Text != nil:
+		return m.estate.Text.loadScoresOf(estateDb, "estate", ids)
+	}
+	return nil
+}
+
+// recordSavedSearchMatches targets の保存された検索条件のうち match が true を返すものに item の一致を記録する
+func recordSavedSearchMatches(targets []string, ids []int64, match func(m *savedSearchMatcher, i int) bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	query, params, err := sqlx.In("SELECT * FROM saved_search WHERE target IN (?)", targets)
+	if err != nil {
+		return err
+	}
+	var searches []SavedSearch
+	if err := chairDb.Select(&searches, chairDb.Rebind(query), params...); err != nil {
+		return err
+	}
+	if len(searches) == 0 {
+		return nil
+	}
+
+	matches := []SavedSearchMatch{}
+	for _, s := range searches {
+		m, err := s.matcher()
+		if err != nil {
+			// 保存時に検証しているので、ここで失敗するのは条件の定義が変わった場合だけ
+			log.Errorf("saved search %v is no longer valid : %v", s.ID, err)
+			continue
+		}
+		if err := m.loadScores(ids); err != nil {
+			return err
+		}
+		for i, id := range ids {
+			if match(m, i) {
+				matches = append(matches, SavedSearchMatch{SavedSearchID: s.ID, ItemID: id})
+			}
+		}
+	}
+
+	for len(matches) > 0 {
+		n := len(matches)
+		if n > importBatchSize {
+			n = importBatchSize
+		}
+		// 同じ椅子や物件が入れ直された場合は最初に一致した記録を残す
+		if _, err := chairDb.NamedExec("INSERT IGNORE INTO saved_search_match (saved_search_id, item_id) VALUES (:saved_search_id, :item_id)", matches[:n]); err != nil {
+			return err
+		}
+		matches = matches[n:]
+	}
+	return nil
+}
+
+// savedSearchJobs 入稿された行を保存された検索条件と照合する処理の待ち行列。
+// 照合は検索条件の数と行数に比例して重いので、入稿のハンドラからは積むだけにする。記録は INSERT IGNORE なので再試行してよい
+var savedSearchJobs = newJobQueue("saved search")
+
+// recordChairMatches 入稿された椅子を保存された検索条件と照合する処理を積む
+func recordChairMatches(chairs []Chair) {
+	ids := make([]int64, 0, len(chairs))
+	for _, chair := range chairs {
+		ids = append(ids, chair.ID)
+	}
+	savedSearchJobs.push(func() error {
+		return recordSavedSearchMatches([]string{savedSearchChair}, ids, func(m *savedSearchMatcher, i int) bool {
+			return m.matchChair(&chairs[i])
+		})
+	})
+}
+
+// recordEstateMatches 入稿された物件を保存された検索条件と照合する処理を積む
+func recordEstateMatches(estates []Estate) {
+	ids := make([]int64, 0, len(estates))
+	for _, estate := range estates {
+		ids = append(ids, estate.ID)
+	}
+	savedSearchJobs.push(func() error {
+		return recordSavedSearchMatches([]string{savedSearchEstate, savedSearchNazotte}, ids, func(m *savedSearchMatcher, i int) bool {
+			return m.matchEstate(&estates[i])
+		})
+	})
+}
+
+type savedSearchRequest struct {
+	Email       string            `json:"email"`
+	Target      string            `json:"target"`
+	Query       map[string]string `json:"query"`
+	Coordinates []Coordinate      `json:"coordinates"`
+}
+
+func postSavedSearch(c echo.Context) error {
+	var req savedSearchRequest
+	if err := c.Bind(&req); err != nil {
+		c.Echo().Logger.Infof("post saved search failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if req.Email == "" {
+		c.Echo().Logger.Info("post saved search failed : email not found in request body")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	s := SavedSearch{Email: req.Email, Target: req.Target}
+	if req.Target == savedSearchNazotte {
+		b, err := json.Marshal(Coordinates{Coordinates: req.Coordinates})
+		if err != nil {
+			c.Echo().Logger.Infof("post saved search failed : %v", err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		s.Query = string(b)
+	} else {
+		params := url.Values{}
+		for k, v := range req.Query {
+			params.Set(k, v)
+		}
+		s.Query = params.Encode()
+	}
+	// 検索ハンドラと同じ解釈で検証してから保存する
+	if _, err := s.matcher(); err != nil {
+		return badSearchRequest(c, err)
+	}
+
+	res, err := chairDb.Exec("INSERT INTO saved_search (email, target, query) VALUES (?, ?, ?)", s.Email, s.Target, s.Query)
+	if err != nil {
+		c.Logger().Errorf("postSavedSearch DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("postSavedSearch DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := chairDb.Get(&s, "SELECT * FROM saved_search WHERE id = ?", id); err != nil {
+		c.Logger().Errorf("postSavedSearch DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, s)
+}
+
+func getSavedSearches(c echo.Context) error {
+	email := c.QueryParam("email")
+	if email == "" {
+		c.Echo().Logger.Info("get saved searches failed : email not found in query")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	searches := []SavedSearch{}
+	if err := chairDb.Select(&searches, "SELECT * FROM saved_search WHERE email = ? ORDER BY id ASC", email); err != nil {
+		c.Logger().Errorf("getSavedSearches DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, searches)
+}
+
+func deleteSavedSearch(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	tx, err := chairDb.Beginx()
+	if err != nil {
+		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM saved_search WHERE id = ?", id)
+	if err != nil {
+		c.Logger().Errorf("deleteSavedSearch DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		c.Echo().Logger.Infof("saved search id %v not found", id)
+		return c.NoContent(http.StatusNotFound)
+	}
+	if _, err := tx.Exec("DELETE FROM saved_search_match WHERE saved_search_id = ?", id); err != nil {
+		c.Logger().Errorf("deleteSavedSearch DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := tx.Commit(); err != nil {
+		c.Echo().Logger.Errorf("transaction commit error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func getSavedSearchMatches(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	page, perPage, err := parsePagination(c)
+	if err != nil {
+		c.Logger().Infof("Invalid format pagination parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	var s SavedSearch
+	if err := chairDb.Get(&s, "SELECT * FROM saved_search WHERE id = ?", id); err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("saved search id %v not found", id)
+			return c.NoContent(http.StatusNotFound)
+		}
+		c.Logger().Errorf("getSavedSearchMatches DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var res SavedSearchMatchListResponse
+	if err := chairDb.Get(&res.Count, "SELECT COUNT(*) FROM saved_search_match WHERE saved_search_id = ?", id); err != nil {
+		c.Logger().Errorf("getSavedSearchMatches DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res.Matches = []SavedSearchMatch{}
+	query := "SELECT * FROM saved_search_match WHERE saved_search_id = ? ORDER BY id DESC LIMIT ? OFFSET ?"
+	if err := chairDb.Select(&res.Matches, query, id, perPage, page*perPage); err != nil {
+		c.Logger().Errorf("getSavedSearchMatches DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+var (
+	// searchMaxPerPage これより大きい perPage は切り詰める
+	searchMaxPerPage = 100
+	// searchMaxPage これより深いページは OFFSET が重くなるので cursor を使ってもらう
+	searchMaxPage = 1000
+)
+
+// searchParamError 検索パラメータの誤り。どのパラメータが悪いかをクライアントに返す
+type searchParamError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *searchParamError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+func invalidSearchParam(field string, format string, args ...interface{}) *searchParamError {
+	return &searchParamError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+type searchErrorResponse struct {
+	Error *searchParamError `json:"error"`
+}
+
+// badSearchRequest 検索パラメータの誤りを 400 で返す
+func badSearchRequest(c echo.Context, err error) error {
+	c.Echo().Logger.Infof("invalid search parameter : %v", err)
+	var pe *searchParamError
+	if !errors.As(err, &pe) {
+		pe = &searchParamError{Message: err.Error()}
+	}
+	return c.JSON(http.StatusBadRequest, searchErrorResponse{Error: pe})
+}
+
+// searchPage 検索結果をどの順に並べてどこを返すか
+type searchPage[T any] struct {
+	Order   sortOrder[T]
+	Cursor  *searchCursor
+	Page    int
+	PerPage int
+}
+
+func (p searchPage[T]) offset() int {
+	if p.Cursor != nil {
+		return 0
+	}
+	return p.Page * p.PerPage
+}
+
+// parseSearchPage sort, cursor, page, perPage パラメータを読む。
+// cursor が指定された場合 page は使わないので省略できる
+func parseSearchPage[T any](params url.Values, orders []sortOrder[T]) (searchPage[T], error) {
+	var p searchPage[T]
+	var err error
+
+	if p.Order, err = findSortOrder(orders, params.Get("sort")); err != nil {
+		return p, invalidSearchParam("sort", "%s", err)
+	}
+
+	if params.Get("cursor") != "" {
+		if p.Cursor, err = decodeSearchCursor(params.Get("cursor")); err != nil {
+			return p, invalidSearchParam("cursor", "%s", err)
+		}
+		if p.Cursor.Sort != p.Order.name {
+			return p, invalidSearchParam("cursor", "was issued for sort %v", p.Cursor.Sort)
+		}
+		if p.Order.relevance {
+			return p, invalidSearchParam("cursor", "cannot be used with sort relevance, use page")
+		}
+	} else {
+		if p.Page, err = strconv.Atoi(params.Get("page")); err != nil {
+			return p, invalidSearchParam("page", "must be an integer")
+		}
+		if p.Page < 0 {
+			return p, invalidSearchParam("page", "must not be negative")
+		}
+		if p.Page > searchMaxPage {
+			return p, invalidSearchParam("page", "must be at most %d, use cursor to read further", searchMaxPage)
+		}
+	}
+
+	if p.PerPage, err = strconv.Atoi(params.Get("perPage")); err != nil {
+		return p, invalidSearchParam("perPage", "must be an integer")
+	}
+	if p.PerPage < 1 {
+		return p, invalidSearchParam("perPage", "must be positive")
+	}
+	if p.PerPage > searchMaxPerPage {
+		p.PerPage = searchMaxPerPage
+	}
+	return p, nil
+}
+
+// parseRangeParam name パラメータを cond の Range の ID として読む。省略された場合は nil を返す
+func parseRangeParam(params url.Values, name string, cond RangeCondition) (*Range, error) {
+	if params.Get(name) == "" {
+		return nil, nil
+	}
+	r, err := getRange(cond, params.Get(name))
+	if err != nil {
+		return nil, invalidSearchParam(name, "unknown range id: %v", params.Get(name))
+	}
+	return r, nil
+}
+
+const (
+	// searchMaxPrice 価格と賃料の上限
+	searchMaxPrice = 100000000
+	// searchMaxSize 椅子の大きさとドアの大きさ (cm) の上限
+	searchMaxSize = 100000
+)
+
+// parseBoundParams name+"Min", name+"Max" パラメータを読んで min 以上 max 以下の Range にする。
+// Range の Max は含まないので max+1 を入れる。どちらも省略された場合は nil を返す
+func parseBoundParams(params url.Values, name string, limit int64) (*Range, error) {
+	r := &Range{ID: -1, Min: -1, Max: -1}
+	var err error
+	bound := func(field string) (int64, error) {
+		v, err := strconv.ParseInt(params.Get(field), 10, 64)
+		if err != nil {
+			return 0, invalidSearchParam(field, "must be an integer")
+		}
+		if v < 0 || limit < v {
+			return 0, invalidSearchParam(field, "must be between 0 and %d", limit)
+		}
+		return v, nil
+	}
+	if params.Get(name+"Min") != "" {
+		if r.Min, err = bound(name + "Min"); err != nil {
+			return nil, err
+		}
+	}
+	if params.Get(name+"Max") != "" {
+		max, err := bound(name + "Max")
+		if err != nil {
+			return nil, err
+		}
+		if r.Min != -1 && max < r.Min {
+			return nil, invalidSearchParam(name+"Max", "must not be less than %sMin", name)
+		}
+		r.Max = max + 1
+	}
+	if r.Min == -1 && r.Max == -1 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// overlaps 2つの Range に共通部分があるかを返す
+func overlaps(a, b *Range) bool {
+	return (a.Max == -1 || b.Min == -1 || b.Min < a.Max) && (b.Max == -1 || a.Min == -1 || a.Min < b.Max)
+}
+
+// parseListParam name パラメータが cond の List に含まれることを確かめる
+func parseListParam(params url.Values, name string, cond ListCondition) (string, error) {
+	v := params.Get(name)
+	if v != "" && !contains(cond.List, v) {
+		return "", invalidSearchParam(name, "unknown value: %v", v)
+	}
+	return v, nil
+}
+
+type searchQuery interface {
+	isEmpty() bool
+	hasText() bool
+}
+
+// parseSearchParams 椅子と物件の検索で共通のパラメータの読み方。
+// 検索条件を parse で読み、条件が1つもなければ誤りとし、並び順とページの指定を読む
+func parseSearchParams[Q searchQuery, T any](params url.Values, parse func(url.Values) (Q, error), orders []sortOrder[T]) (Q, searchPage[T], error) {
+	q, err := parse(params)
+	if err != nil {
+		return q, searchPage[T]{}, err
+	}
+	if q.isEmpty() {
+		return q, searchPage[T]{}, invalidSearchParam("condition", "search condition not found")
+	}
+	p, err := parseSearchPage(params, orders)
+	if err == nil && p.Order.relevance && !q.hasText() {
+		return q, p, invalidSearchParam("sort", "relevance requires q")
+	}
+	return q, p, err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestParseBoundParams(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		want      *Range
+		wantField string
+	}{
+		{"omitted", "", nil, ""},
+		{"empty values", "priceMin=&priceMax=", nil, ""},
+		{"min only", "priceMin=100", &Range{ID: -1, Min: 100, Max: -1}, ""},
+		{"max only", "priceMax=200", &Range{ID: -1, Min: -1, Max: 201}, ""},
+		{"min and max", "priceMin=100&priceMax=200", &Range{ID: -1, Min: 100, Max: 201}, ""},
+		{"min equals max", "priceMin=150&priceMax=150", &Range{ID: -1, Min: 150, Max: 151}, ""},
+		{"zero min", "priceMin=0", &Range{ID: -1, Min: 0, Max: -1}, ""},
+		{"max at limit", "priceMax=1000", &Range{ID: -1, Min: -1, Max: 1001}, ""},
+		{"min not a number", "priceMin=abc", nil, "priceMin"},
+		{"max not a number", "priceMax=1.5", nil, "priceMax"},
+		{"negative min", "priceMin=-1", nil, "priceMin"},
+		{"max over limit", "priceMax=1001", nil, "priceMax"},
+		{"max less than min", "priceMin=200&priceMax=100", nil, "priceMax"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseBoundParams(params, "price", 1000)
+			if tt.wantField != "" {
+				var paramErr *searchParamError
+				if !errors.As(err, &paramErr) || paramErr.Field != tt.wantField {
+					t.Errorf("parseBoundParams(%q) error = %v, want error on %v", tt.query, err, tt.wantField)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseBoundParams(%q) error = %v", tt.query, err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseBoundParams(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
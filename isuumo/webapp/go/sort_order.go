@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sortOrder 検索結果の並び順。column の順に並べ、同じ値の中では id で同じ向きに並べる。
+// 降順でも (column, id) のインデックスを逆向きに読めば済むようにするため、id の向きも揃える
+type sortOrder[T any] struct {
+	name   string
+	column string
+	desc   bool
+	// key 並び順のキーと id を返す
+	key func(v *T) (int64, int64)
+	// relevance q パラメータとの関連度の高い順に並べる。関連度は小数なので cursor は使えない
+	relevance bool
+}
+
+var chairSortOrders = []sortOrder[Chair]{
+	{name: "popularity", column: "popularity_m", key: func(c *Chair) (int64, int64) { return c.PopularityM, c.ID }},
+	{name: "price_asc", column: "price", key: func(c *Chair) (int64, int64) { return c.Price, c.ID }},
+	{name: "price_desc", column: "price", desc: true, key: func(c *Chair) (int64, int64) { return c.Price, c.ID }},
+	{name: "width_desc", column: "width", desc: true, key: func(c *Chair) (int64, int64) { return c.Width, c.ID }},
+	{name: "height_desc", column: "height", desc: true, key: func(c *Chair) (int64, int64) { return c.Height, c.ID }},
+	{name: "newest", column: "id", desc: true, key: func(c *Chair) (int64, int64) { return c.ID, c.ID }},
+	{name: "relevance", relevance: true},
+}
+
+var estateSortOrders = []sortOrder[Estate]{
+	{name: "popularity", column: "popularity_m", key: func(e *Estate) (int64, int64) { return e.PopularityM, e.ID }},
+	{name: "rent_asc", column: "rent", key: func(e *Estate) (int64, int64) { return e.Rent, e.ID }},
+	{name: "rent_desc", column: "rent", desc: true, key: func(e *Estate) (int64, int64) { return e.Rent, e.ID }},
+	{name: "door_width_desc", column: "door_width", desc: true, key: func(e *Estate) (int64, int64) { return e.DoorWidth, e.ID }},
+	{name: "door_height_desc", column: "door_height", desc: true, key: func(e *Estate) (int64, int64) { return e.DoorHeight, e.ID }},
+	{name: "newest", column: "id", desc: true, key: func(e *Estate) (int64, int64) { return e.ID, e.ID }},
+	{name: "relevance", relevance: true},
+}
+
+// findSortOrder sort パラメータに対応する並び順を返す。省略された場合は最初の並び順とする
+func findSortOrder[T any](orders []sortOrder[T], name string) (sortOrder[T], error) {
+	if name == "" {
+		return orders[0], nil
+	}
+	for _, o := range orders {
+		if o.name == name {
+			return o, nil
+		}
+	}
+	names := make([]string, 0, len(orders))
+	for _, o := range orders {
+		names = append(names, o.name)
+	}
+	return sortOrder[T]{}, fmt.Errorf("must be one of %s", strings.Join(names, ", "))
+}
+
+func (o sortOrder[T]) isDefault() bool {
+	return o.name == "popularity"
+}
+
+func (o sortOrder[T]) cursorable() bool {
+	return !o.relevance
+}
+
+func (o sortOrder[T]) less(a, b *T) bool {
+	ak, aid := o.key(a)
+	bk, bid := o.key(b)
+	if ak != bk {
+		return (ak < bk) != o.desc
+	}
+	return (aid < bid) != o.desc
+}
+
+// cursor v の次から読むための cursor を作る
+func (o sortOrder[T]) cursor(v *T) string {
+	key, id := o.key(v)
+	return searchCursor{Sort: o.name, Key: key, ID: id}.encode()
+}
+
+// after v が c の位置より後ろにあるかを返す
+func (o sortOrder[T]) after(c *searchCursor, v *T) bool {
+	key, id := o.key(v)
+	if key != c.Key {
+		return (key > c.Key) != o.desc
+	}
+	// cursor の行そのものは前のページで返しているので、どちらの向きでも含めない
+	return id != c.ID && (id > c.ID) != o.desc
+}
+
+func (o sortOrder[T]) direction() string {
+	if o.desc {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func (o sortOrder[T]) orderBy() string {
+	if o.relevance {
+		return " ORDER BY relevance DESC, id ASC"
+	}
+	if o.column == "id" {
+		return " ORDER BY id " + o.direction()
+	}
+	return fmt.Sprintf(" ORDER BY %s %s, id %s", o.column, o.direction(), o.direction())
+}
+
+// cursorCondition c の位置より後ろの行を選ぶ WHERE 句の条件
+func (o sortOrder[T]) cursorCondition(c *searchCursor) (string, []interface{}) {
+	op := ">"
+	if o.desc {
+		op = "<"
+	}
+	if o.column == "id" {
+		return "id " + op + " ?", []interface{}{c.ID}
+	}
+	return fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", o.column, op, o.column, op), []interface{}{c.Key, c.Key, c.ID}
+}
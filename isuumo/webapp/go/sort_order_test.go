@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSortOrderTieBreak(t *testing.T) {
+	chairs := []Chair{
+		{ID: 3, Price: 100},
+		{ID: 1, Price: 200},
+		{ID: 5, Price: 100},
+		{ID: 2, Price: 200},
+		{ID: 4, Price: 100},
+	}
+	tests := []struct {
+		sort string
+		want []int64
+	}{
+		{"price_asc", []int64{3, 4, 5, 1, 2}},
+		{"price_desc", []int64{2, 1, 5, 4, 3}},
+		{"newest", []int64{5, 4, 3, 2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			o, err := findSortOrder(chairSortOrders, tt.sort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sorted := append([]Chair{}, chairs...)
+			sort.Slice(sorted, func(i, j int) bool { return o.less(&sorted[i], &sorted[j]) })
+			ids := make([]int64, 0, len(sorted))
+			for _, c := range sorted {
+				ids = append(ids, c.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("sorted ids = %v, want %v", ids, tt.want)
+			}
+
+			// cursor の次に来るのは、並べた結果でその行より後ろの行だけ
+			for i := range sorted {
+				c, err := decodeSearchCursor(o.cursor(&sorted[i]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for j := range sorted {
+					if got := o.after(c, &sorted[j]); got != (j > i) {
+						t.Errorf("after(cursor of id %d, id %d) = %v, want %v", sorted[i].ID, sorted[j].ID, got, j > i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSortOrderSQL(t *testing.T) {
+	tests := []struct {
+		sort          string
+		wantOrderBy   string
+		wantCondition string
+		wantParams    []interface{}
+	}{
+		{"price_asc", " ORDER BY price ASC, id ASC", "(price > ? OR (price = ? AND id > ?))", []interface{}{int64(100), int64(100), int64(7)}},
+		{"price_desc", " ORDER BY price DESC, id DESC", "(price < ? OR (price = ? AND id < ?))", []interface{}{int64(100), int64(100), int64(7)}},
+		{"newest", " ORDER BY id DESC", "id < ?", []interface{}{int64(7)}},
+		{"relevance", " ORDER BY relevance DESC, id ASC", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			o, err := findSortOrder(chairSortOrders, tt.sort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := o.orderBy(); got != tt.wantOrderBy {
+				t.Errorf("orderBy() = %q, want %q", got, tt.wantOrderBy)
+			}
+			if !o.cursorable() {
+				return
+			}
+			cond, params := o.cursorCondition(&searchCursor{Sort: tt.sort, Key: 100, ID: 7})
+			if cond != tt.wantCondition || !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("cursorCondition() = %q %v, want %q %v", cond, params, tt.wantCondition, tt.wantParams)
+			}
+		})
+	}
+}
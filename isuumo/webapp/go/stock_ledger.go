@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+type stockEntry struct {
+	stock int64
+	// held 仮押さえされていて stock から引いてある数
+	held  int64
+	dirty uint32
+}
+
+// stockLedger 椅子の在庫数の正本をメモリ上に持つ台帳。
+// 購入は atomic な CAS で在庫を減らし、chair.stock へは flusher が非同期に書き戻す
+type stockLedger struct {
+	// mu entries の追加と入れ替えを守る。在庫数の増減は atomic に行う
+	mu      sync.RWMutex
+	entries map[int64]*stockEntry
+
+	// flushMu 書き戻しと台帳の作り直しが同時に走らないようにする
+	flushMu sync.Mutex
+}
+
+var chairStockLedger = &stockLedger{entries: map[int64]*stockEntry{}}
+
+// recoverStockQuery 最後に書き戻した時点の在庫数から、それ以降に記録された購入と仮押さえを差し引く。
+// 書き戻し済みの分を二重に引くことはあっても引き漏らすことはないので、売り越しにはならない
+const recoverStockQuery = "SELECT c.id AS id, c.stock AS flushed, c.stock" +
+	" - COALESCE((SELECT SUM(o.quantity) FROM chair_order o WHERE o.chair_id = c.id AND o.id > c.stock_order_id AND o.reservation_id IS NULL), 0)" +
+	" - COALESCE((SELECT SUM(r.quantity) FROM chair_reservation r WHERE r.chair_id = c.id AND r.id > c.stock_reservation_id AND r.status != 'released'), 0)" +
+	" AS stock FROM chair c"
+
+// PauseFlush 書き戻しを止める。/initialize のように DB を作り直す間に古い在庫数を書き込まないようにする
+func (l *stockLedger) PauseFlush() func() {
+	l.flushMu.Lock()
+	return l.flushMu.Unlock
+}
+
+// Load MySQL から台帳を作り直す。書き戻しを止めた状態で呼ぶ
+func (l *stockLedger) Load(db *sqlx.DB) error {
+	var rows []struct {
+		ID      int64 `db:"id"`
+		Flushed int64 `db:"flushed"`
+		Stock   int64 `db:"stock"`
+	}
+	if err := db.Select(&rows, recoverStockQuery); err != nil {
+		return err
+	}
+
+	entries := make(map[int64]*stockEntry, len(rows))
+	for _, r := range rows {
+		if r.Stock < 0 {
+			r.Stock = 0
+		}
+		e := &stockEntry{stock: r.Stock}
+		if r.Stock != r.Flushed {
+			e.dirty = 1
+		}
+		entries[r.ID] = e
+	}
+
+	var held []struct {
+		ChairID  int64 `db:"chair_id"`
+		Quantity int64 `db:"quantity"`
+	}
+	if err := db.Select(&held, "SELECT chair_id, SUM(quantity) AS quantity FROM chair_reservation WHERE status = ? GROUP BY chair_id", reservationHeld); err != nil {
+		return err
+	}
+	for _, h := range held {
+		if e, ok := entries[h.ChairID]; ok {
+			e.held = h.Quantity
+		}
+	}
+
+	l.mu.Lock()
+	l.entries = entries
+	l.mu.Unlock()
+	return l.flush(db)
+}
+
+func (l *stockLedger) entry(id int64) *stockEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.entries[id]
+}
+
+// Get 在庫数を返す
+func (l *stockLedger) Get(id int64) (int64, bool) {
+	e := l.entry(id)
+	if e == nil {
+		return 0, false
+	}
+	return atomic.LoadInt64(&e.stock), true
+}
+
+// Set 入稿された椅子の在庫数で台帳を上書きし、上書きした後の在庫数を返す。
+// 仮押さえ中の数は期限切れで戻ってくるので、入稿された在庫数から引いておく。
+// そのため在庫数は負になることがあるが、Take は在庫が足りないものとして扱う
+func (l *stockLedger) Set(id int64, stock int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[id]
+	if !ok {
+		// 入稿時に chair.stock へ書き込み済みなので書き戻す必要はない
+		l.entries[id] = &stockEntry{stock: stock}
+		return stock
+	}
+	stock -= atomic.LoadInt64(&e.held)
+	atomic.StoreInt64(&e.stock, stock)
+	atomic.StoreUint32(&e.dirty, 1)
+	return stock
+}
+
+// Take 在庫を n 減らす。足りない場合は減らさずに ok = false を返す。before は減らす前の在庫数
+func (l *stockLedger) Take(id int64, n int64) (before int64, ok bool) {
+	e := l.entry(id)
+	if e == nil {
+		return 0, false
+	}
+	for {
+		before = atomic.LoadInt64(&e.stock)
+		if before < n {
+			return before, false
+		}
+		if atomic.CompareAndSwapInt64(&e.stock, before, before-n) {
+			atomic.StoreUint32(&e.dirty, 1)
+			return before, true
+		}
+	}
+}
+
+// Hold 在庫を n 仮押さえする。足りない場合は押さえずに ok = false を返す。before は押さえる前の在庫数
+func (l *stockLedger) Hold(id int64, n int64) (before int64, ok bool) {
+	e := l.entry(id)
+	if e == nil {
+		return 0, false
+	}
+	// 先に held を増やしておき、並行した Set が引き漏らさないようにする。引きすぎても売り越しにはならない
+	atomic.AddInt64(&e.held, n)
+	before, ok = l.Take(id, n)
+	if !ok {
+		atomic.AddInt64(&e.held, -n)
+	}
+	return before, ok
+}
+
+// Release 仮押さえしていた n を在庫に戻す。before は戻す前の在庫数
+func (l *stockLedger) Release(id int64, n int64) (before int64) {
+	e := l.entry(id)
+	if e == nil {
+		return 0
+	}
+	atomic.AddInt64(&e.held, -n)
+	return l.Put(id, n)
+}
+
+// Settle 仮押さえしていた n を購入済みにする。在庫は押さえた時点で引いてある
+func (l *stockLedger) Settle(id int64, n int64) {
+	if e := l.entry(id); e != nil {
+		atomic.AddInt64(&e.held, -n)
+	}
+}
+
+// Put 在庫を n 戻す。before は戻す前の在庫数
+func (l *stockLedger) Put(id int64, n int64) (before int64) {
+	e := l.entry(id)
+	if e == nil {
+		return 0
+	}
+	after := atomic.AddInt64(&e.stock, n)
+	atomic.StoreUint32(&e.dirty, 1)
+	return after - n
+}
+
+// Flush 変更のあった在庫数を chair.stock に書き戻す
+func (l *stockLedger) Flush(db *sqlx.DB) error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	return l.flush(db)
+}
+
+func (l *stockLedger) flush(db *sqlx.DB) error {
+	l.mu.RLock()
+	dirty := make(map[int64]*stockEntry)
+	for id, e := range l.entries {
+		if atomic.CompareAndSwapUint32(&e.dirty, 1, 0) {
+			dirty[id] = e
+		}
+	}
+	l.mu.RUnlock()
+	if len(dirty) == 0 {
+		return nil
+	}
+	redirty := func() {
+		for _, e := range dirty {
+			atomic.StoreUint32(&e.dirty, 1)
+		}
+	}
+
+	// 在庫数を読む前に記録済みの購入と仮押さえの最大 id を読んでおく。
+	// これ以下の id の行は読んだ在庫数に必ず反映されている
+	var orderID, reservationID int64
+	if err := db.Get(&orderID, "SELECT COALESCE(MAX(id), 0) FROM chair_order"); err != nil {
+		redirty()
+		return err
+	}
+	if err := db.Get(&reservationID, "SELECT COALESCE(MAX(id), 0) FROM chair_reservation"); err != nil {
+		redirty()
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		redirty()
+		return err
+	}
+	defer tx.Rollback()
+	for id, e := range dirty {
+		stock := atomic.LoadInt64(&e.stock)
+		if _, err := tx.Exec("UPDATE chair SET stock = ?, stock_order_id = ?, stock_reservation_id = ? WHERE id = ?", stock, orderID, reservationID, id); err != nil {
+			redirty()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		redirty()
+		return err
+	}
+	return nil
+}
+
+// runStockFlusher interval ごとに台帳を chair.stock に書き戻す
+func runStockFlusher(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := chairStockLedger.Flush(chairDb); err != nil {
+			log.Errorf("failed to flush chair stock : %v", err)
+		}
+	}
+}
+
+// chairStockApplyLocks 同じ椅子の在庫の反映が並行しないように id で選ぶロック
+var chairStockApplyLocks [64]sync.Mutex
+
+// applyChairStock 台帳の在庫数を検索インデックスとキャッシュに反映する。
+// 並行した購入と在庫の戻しは台帳を変えた順に反映されるとは限らないので、変化の前後の値ではなく
+// 椅子ごとのロックの中で読んだ台帳の現在の在庫数とインデックスの状態を比べる。
+// 在庫がなくなったときと戻ったときには対になるイベントを送る。仮押さえで在庫がなくなり期限切れで戻る場合もある
+func applyChairStock(id int64) {
+	mu := &chairStockApplyLocks[uint64(id)%uint64(len(chairStockApplyLocks))]
+	mu.Lock()
+	defer mu.Unlock()
+
+	stock, ok := chairStockLedger.Get(id)
+	if !ok {
+		return
+	}
+	listed := chairSearchIndex.Listed(id)
+	switch {
+	case listed && stock > 0:
+		chairSearchIndex.SetStock(id, stock)
+		return
+	case listed && stock <= 0:
+		chairSearchIndex.SetStock(id, 0)
+		publishWebhookEvent(webhookChairSoldOut, struct {
+			ChairID int64 `json:"chairId"`
+		}{id})
+	case !listed && stock > 0:
+		// 在庫切れから戻った椅子は検索インデックスに入れ直す
+		chair, err := chairDetailCache.Get(context.Background(), int(id))
+		if err != nil {
+			log.Errorf("failed to get chair %v : %v", id, err)
+			return
+		}
+		restocked := *chair
+		restocked.Stock = stock
+		chairSearchIndex.Add([]Chair{restocked})
+		publishWebhookEvent(webhookChairRestocked, struct {
+			ChairID int64 `json:"chairId"`
+			Stock   int64 `json:"stock"`
+		}{id, stock})
+	default:
+		return
+	}
+	// 安い順の一覧は在庫の有無が変わったときだけ作り直す
+	lowPricedChairCache.Purge()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const (
+	suggestDefaultLimit = 10
+	suggestMaxLimit     = 50
+)
+
+type suggestEntry struct {
+	text       string
+	popularity int64
+}
+
+// suggestRow 補完の元になる椅子や物件の1行
+type suggestRow struct {
+	ID         int64  `db:"id"`
+	Text       string `db:"text"`
+	Popularity int64  `db:"popularity"`
+}
+
+// suggestIndex 文字列を辞書順に並べた前方一致用のインデックス。
+// 同じ文字列を持つ行が複数ある場合は一番人気の高いものの人気度を使う
+type suggestIndex struct {
+	mu sync.RWMutex
+
+	entries []suggestEntry
+	// texts 文字列ごとの、その文字列を持つ行の id と人気度
+	texts map[string]map[int64]int64
+	// byID 行ごとの文字列。名前や住所が変わった行を元の文字列から外すために覚えておく
+	byID map[int64]string
+}
+
+var (
+	chairNameSuggest     = &suggestIndex{texts: map[string]map[int64]int64{}, byID: map[int64]string{}}
+	estateAddressSuggest = &suggestIndex{texts: map[string]map[int64]int64{}, byID: map[int64]string{}}
+)
+
+// Load query で読んだ id, text, popularity からインデックスを作り直す
+func (idx *suggestIndex) Load(db *sqlx.DB, query string) error {
+	var rows []suggestRow
+	if err := db.Select(&rows, query); err != nil {
+		return err
+	}
+	texts := map[string]map[int64]int64{}
+	byID := make(map[int64]string, len(rows))
+	for _, r := range rows {
+		putSuggestRow(texts, byID, r)
+	}
+	entries := make([]suggestEntry, 0, len(texts))
+	for text, ids := range texts {
+		entries = append(entries, suggestEntry{text: text, popularity: maxPopularity(ids)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].text < entries[j].text })
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.entries = entries
+	idx.texts = texts
+	idx.byID = byID
+	return nil
+}
+
+// Add 新しく登録または更新された行をインデックスに反映する。
+// 変わった文字列の分だけを並べ直し、並んでいる entries に差し込む
+func (idx *suggestIndex) Add(rows []suggestRow) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	changed := map[string]struct{}{}
+	for _, r := range rows {
+		if old, ok := idx.byID[r.ID]; ok {
+			delete(idx.texts[old], r.ID)
+			if len(idx.texts[old]) == 0 {
+				delete(idx.texts, old)
+			}
+			changed[old] = struct{}{}
+		}
+		putSuggestRow(idx.texts, idx.byID, r)
+		changed[r.Text] = struct{}{}
+	}
+
+	batch := make([]suggestEntry, 0, len(changed))
+	for text := range changed {
+		if ids, ok := idx.texts[text]; ok {
+			batch = append(batch, suggestEntry{text: text, popularity: maxPopularity(ids)})
+		}
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].text < batch[j].text })
+
+	entries := make([]suggestEntry, 0, len(idx.entries)+len(batch))
+	i := 0
+	for _, e := range idx.entries {
+		if _, ok := changed[e.text]; ok {
+			continue
+		}
+		for i < len(batch) && batch[i].text < e.text {
+			entries = append(entries, batch[i])
+			i++
+		}
+		entries = append(entries, e)
+	}
+	idx.entries = append(entries, batch[i:]...)
+}
+
+// Suggest prefix で始まる文字列を人気順に最大 limit 件返す
+func (idx *suggestIndex) Suggest(prefix string, limit int) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// 辞書順に並んでいるので、前方一致するものは連続した範囲になる
+	lo := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].text >= prefix })
+	hi := lo
+	for hi < len(idx.entries) && strings.HasPrefix(idx.entries[hi].text, prefix) {
+		hi++
+	}
+
+	matches := make([]suggestEntry, hi-lo)
+	copy(matches, idx.entries[lo:hi])
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].popularity > matches[j].popularity })
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	texts := make([]string, 0, len(matches))
+	for _, m := range matches {
+		texts = append(texts, m.text)
+	}
+	return texts
+}
+
+func putSuggestRow(texts map[string]map[int64]int64, byID map[int64]string, r suggestRow) {
+	ids, ok := texts[r.Text]
+	if !ok {
+		ids = map[int64]int64{}
+		texts[r.Text] = ids
+	}
+	ids[r.ID] = r.Popularity
+	byID[r.ID] = r.Text
+}
+
+func maxPopularity(ids map[int64]int64) int64 {
+	max := int64(0)
+	for _, popularity := range ids {
+		if popularity > max {
+			max = popularity
+		}
+	}
+	return max
+}
+
+// loadSuggestIndexes 椅子の名前と物件の住所の補完用インデックスを作り直す
+func loadSuggestIndexes() error {
+	if err := chairNameSuggest.Load(chairDb, "SELECT id, name AS text, popularity FROM chair"); err != nil {
+		return err
+	}
+	return estateAddressSuggest.Load(estateDb, "SELECT id, address AS text, popularity FROM estate")
+}
+
+func addChairSuggestions(chairs []Chair) {
+	rows := make([]suggestRow, 0, len(chairs))
+	for _, chair := range chairs {
+		rows = append(rows, suggestRow{ID: chair.ID, Text: chair.Name, Popularity: chair.Popularity})
+	}
+	chairNameSuggest.Add(rows)
+}
+
+func addEstateSuggestions(estates []Estate) {
+	rows := make([]suggestRow, 0, len(estates))
+	for _, estate := range estates {
+		rows = append(rows, suggestRow{ID: estate.ID, Text: estate.Address, Popularity: estate.Popularity})
+	}
+	estateAddressSuggest.Add(rows)
+}
+
+type SuggestResponse struct {
+	Suggestions []string `json:"suggestions"`
+}
+
+func getSuggestions(c echo.Context) error {
+	var idx *suggestIndex
+	switch c.QueryParam("type") {
+	case "chair":
+		idx = chairNameSuggest
+	case "estate":
+		idx = estateAddressSuggest
+	default:
+		return badSearchRequest(c, invalidSearchParam("type", "must be chair or estate"))
+	}
+
+	prefix := c.QueryParam("prefix")
+	if prefix == "" {
+		return badSearchRequest(c, invalidSearchParam("prefix", "must not be empty"))
+	}
+
+	limit := suggestDefaultLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return badSearchRequest(c, invalidSearchParam("limit", "must be a positive integer"))
+		}
+		if n < suggestMaxLimit {
+			limit = n
+		} else {
+			limit = suggestMaxLimit
+		}
+	}
+
+	return c.JSON(http.StatusOK, SuggestResponse{Suggestions: idx.Suggest(prefix, limit)})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// textMinTermLength ngram_token_size (既定の2) より短い語は FULLTEXT インデックスで引けない
+	textMinTermLength = 2
+	textMaxTermLength = 64
+	textMaxTerms      = 8
+
+	// textMatchSQL name, description の FULLTEXT (ngram) インデックスを使う条件
+	textMatchSQL = "MATCH(name, description) AGAINST(? IN BOOLEAN MODE)"
+)
+
+// textQuery q パラメータのキーワード検索。空白で区切った語をすべて含むものに一致する
+type textQuery struct {
+	Terms []string
+
+	// scores 椅子の検索で FULLTEXT インデックスから引いた id ごとの関連度
+	scores map[int64]float64
+}
+
+// parseTextQuery q パラメータを読む。省略された場合は nil を返す
+func parseTextQuery(param string) (*textQuery, error) {
+	// BOOLEAN MODE の演算子として解釈される記号は語の区切りとして扱う
+	fields := strings.FieldsFunc(param, func(r rune) bool {
+		return strings.ContainsRune(" \t　\"+-<>()~*@", r)
+	})
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if len(fields) > textMaxTerms {
+		return nil, invalidSearchParam("q", "must have at most %d terms", textMaxTerms)
+	}
+	for _, f := range fields {
+		if n := utf8.RuneCountInString(f); n < textMinTermLength || textMaxTermLength < n {
+			return nil, invalidSearchParam("q", "each term must be %d to %d characters", textMinTermLength, textMaxTermLength)
+		}
+	}
+	return &textQuery{Terms: fields}, nil
+}
+
+// against BOOLEAN MODE の検索式にする。各語をフレーズとして必須にすると、ngram では部分文字列の一致になる
+func (t *textQuery) against() string {
+	phrases := make([]string, 0, len(t.Terms))
+	for _, term := range t.Terms {
+		phrases = append(phrases, `+"`+term+`"`)
+	}
+	return strings.Join(phrases, " ")
+}
+
+// match id の行が FULLTEXT インデックスで一致したかを返す。
+// 検索と違う基準で判定しないように、loadScores か loadScoresOf で関連度を引いていなければ一致しないものとする
+func (t *textQuery) match(id int64) bool {
+	_, ok := t.scores[id]
+	return ok
+}
+
+// loadScores 椅子の FULLTEXT インデックスから一致する id と関連度を引く
+func (t *textQuery) loadScores(db *sqlx.DB) error {
+	t.scores = map[int64]float64{}
+	against := t.against()
+	return t.addScores(db, "SELECT id, "+textMatchSQL+" AS relevance FROM chair WHERE "+textMatchSQL, against, against)
+}
+
+// loadScoresOf table の ids の行について FULLTEXT インデックスから関連度を引く。
+// 保存された検索条件の照合で、入稿された行を検索と同じ基準で判定するために使う
+func (t *textQuery) loadScoresOf(db *sqlx.DB, table string, ids []int64) error {
+	t.scores = make(map[int64]float64, len(ids))
+	against := t.against()
+	for start := 0; start < len(ids); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		query, params, err := sqlx.In("SELECT id, "+textMatchSQL+" AS relevance FROM `"+table+"` WHERE id IN (?) AND "+textMatchSQL, against, ids[start:end], against)
+		if err != nil {
+			return err
+		}
+		if err := t.addScores(db, db.Rebind(query), params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *textQuery) addScores(db *sqlx.DB, query string, params ...interface{}) error {
+	var rows []struct {
+		ID        int64   `db:"id"`
+		Relevance float64 `db:"relevance"`
+	}
+	if err := db.Select(&rows, query, params...); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		t.scores[r.ID] = r.Relevance
+	}
+	return nil
+}
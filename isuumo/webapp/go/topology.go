@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// schemaFile /initialize が読み込むスキーマの定義
+var schemaFile = filepath.Join("..", "mysql", "db", "0_Schema.sql")
+
+// schemaVersion このアプリケーションが前提とするスキーマの版。起動時に schemaFile から読む
+var schemaVersion int
+
+var schemaVersionPattern = regexp.MustCompile(`(?i)INSERT\s+INTO\s+(?:isuumo\.)?schema_version\s*\(\s*id\s*,\s*schema_version\s*\)\s*VALUES\s*\(\s*1\s*,\s*(\d+)\s*\)\s*;`)
+
+// readSchemaFileVersion スキーマの定義が schema_version テーブルに入れる版を読む。
+// 版を書く場所をスキーマの定義の1箇所にして、アプリケーションとの食い違いをなくす
+func readSchemaFileVersion(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := parseSchemaVersion(b)
+	if err != nil {
+		return 0, fmt.Errorf("%v : %w", path, err)
+	}
+	return v, nil
+}
+
+// parseSchemaVersion schema_version に id = 1 の1行だけを入れる INSERT から版を読む。
+// 版が決まらないように見えるもの (INSERT がない、複数ある、複数行を入れる) は誤りとする
+func parseSchemaVersion(schema []byte) (int, error) {
+	ms := schemaVersionPattern.FindAllSubmatch(schema, -1)
+	switch len(ms) {
+	case 0:
+		return 0, fmt.Errorf("schema version not found")
+	case 1:
+		return strconv.Atoi(string(ms[0][1]))
+	}
+	return 0, fmt.Errorf("schema version is inserted %d times", len(ms))
+}
+
+// DBVersion schema_version テーブルの内容。初期データの版は椅子と物件の両方をどちらの DB にも入れる
+type DBVersion struct {
+	SchemaVersion     int       `db:"schema_version" json:"schemaVersion"`
+	ChairDataVersion  string    `db:"chair_data_version" json:"chairDataVersion"`
+	EstateDataVersion string    `db:"estate_data_version" json:"estateDataVersion"`
+	UpdatedAt         time.Time `db:"updated_at" json:"updatedAt"`
+}
+
+func readDBVersion(db *sqlx.DB) (DBVersion, error) {
+	var v DBVersion
+	err := db.Get(&v, "SELECT schema_version, chair_data_version, estate_data_version, updated_at FROM schema_version WHERE id = 1")
+	return v, err
+}
+
+// checkDBVersions 椅子と物件の DB がどちらもこのアプリケーションのスキーマで、同じ初期データから作られているかを確かめる。
+// おすすめのように両方の DB を組み合わせる処理は、別々の初期データが入っていると黙って誤った結果を返すので、ここで弾く。
+// want の初期データの版が空でなければ、両方の DB の版がそれと一致することも確かめる
+func checkDBVersions(want DBVersion) error {
+	chair, err := readDBVersion(chairDb)
+	if err != nil {
+		return fmt.Errorf("failed to read chair db version : %w", err)
+	}
+	estate, err := readDBVersion(estateDb)
+	if err != nil {
+		return fmt.Errorf("failed to read estate db version : %w", err)
+	}
+	return compareDBVersions(chair, estate, want)
+}
+
+func compareDBVersions(chair, estate, want DBVersion) error {
+	if chair.SchemaVersion != want.SchemaVersion {
+		return fmt.Errorf("chair db schema version is %d, want %d", chair.SchemaVersion, want.SchemaVersion)
+	}
+	if estate.SchemaVersion != want.SchemaVersion {
+		return fmt.Errorf("estate db schema version is %d, want %d", estate.SchemaVersion, want.SchemaVersion)
+	}
+	if want.ChairDataVersion != "" && chair.ChairDataVersion != want.ChairDataVersion {
+		return fmt.Errorf("chair data version in chair db is %q, want %q", chair.ChairDataVersion, want.ChairDataVersion)
+	}
+	if want.EstateDataVersion != "" && chair.EstateDataVersion != want.EstateDataVersion {
+		return fmt.Errorf("estate data version in chair db is %q, want %q", chair.EstateDataVersion, want.EstateDataVersion)
+	}
+	if chair.ChairDataVersion != estate.ChairDataVersion {
+		return fmt.Errorf("chair data version %q in chair db differs from %q in estate db", chair.ChairDataVersion, estate.ChairDataVersion)
+	}
+	if chair.EstateDataVersion != estate.EstateDataVersion {
+		return fmt.Errorf("estate data version %q in chair db differs from %q in estate db", chair.EstateDataVersion, estate.EstateDataVersion)
+	}
+	return nil
+}
+
+// seedDataVersion 初期データのファイルの内容から版を作る
+func seedDataVersion(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// setDataVersion 椅子と物件の初期データの版を記録する。片方の DB だけ入れ直された場合に気づけるように、両方の DB に両方を入れる
+func setDataVersion(db *sqlx.DB, chairVersion, estateVersion string) error {
+	_, err := db.Exec("UPDATE schema_version SET chair_data_version = ?, estate_data_version = ? WHERE id = 1", chairVersion, estateVersion)
+	return err
+}
+
+// topologyTables 各 DB で件数を数えるテーブル。スキーマは両方の DB に入るので、使っていない側が空であることも見える
+var topologyTables = []string{"chair", "estate"}
+
+// BackendStatus 1つの DB の接続先と状態
+type BackendStatus struct {
+	Name      string           `json:"name"`
+	Host      string           `json:"host"`
+	Port      string           `json:"port"`
+	DBName    string           `json:"dbName"`
+	Version   *DBVersion       `json:"version"`
+	RowCounts map[string]int64 `json:"rowCounts"`
+	Replicas  []ReplicaStatus  `json:"replicas"`
+	Error     string           `json:"error,omitempty"`
+}
+
+type TopologyResponse struct {
+	Consistent bool            `json:"consistent"`
+	Error      string          `json:"error,omitempty"`
+	Backends   []BackendStatus `json:"backends"`
+}
+
+// backendStatus 接続できない場合もトポロジ全体は返したいので、エラーは Error に入れる
+func backendStatus(name string, conn *MySQLConnectionEnv, rs *replicaSet) BackendStatus {
+	s := BackendStatus{
+		Name:      name,
+		Host:      conn.Host,
+		Port:      conn.Port,
+		DBName:    conn.DBName,
+		RowCounts: map[string]int64{},
+		Replicas:  rs.status(),
+	}
+	db := rs.primary
+	v, err := readDBVersion(db)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Version = &v
+	for _, table := range topologyTables {
+		var n int64
+		if err := db.Get(&n, "SELECT COUNT(*) FROM "+table); err != nil {
+			s.Error = err.Error()
+			return s
+		}
+		s.RowCounts[table] = n
+	}
+	return s
+}
+
+// getTopology 椅子と物件の DB の接続先、版、件数と、レプリカがあればその遅延を返す
+func getTopology(c echo.Context) error {
+	res := TopologyResponse{
+		Backends: []BackendStatus{
+			backendStatus("chair", mySQLConnectionDataChair, chairReplicas),
+			backendStatus("estate", mySQLConnectionDataEstate, estateReplicas),
+		},
+	}
+	if err := checkDBVersions(DBVersion{SchemaVersion: schemaVersion}); err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Consistent = true
+	}
+	return c.JSON(http.StatusOK, res)
+}
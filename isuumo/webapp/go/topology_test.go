@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestReadSchemaFileVersion(t *testing.T) {
+	v, err := readSchemaFileVersion(schemaFile)
+	if err != nil {
+		t.Fatalf("readSchemaFileVersion(%q) error = %v", schemaFile, err)
+	}
+	if v <= 0 {
+		t.Errorf("readSchemaFileVersion(%q) = %d, want a positive version", schemaFile, v)
+	}
+}
+
+func TestParseSchemaVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		want    int
+		wantErr bool
+	}{
+		{"single row", "CREATE TABLE isuumo.chair (id INTEGER);\nINSERT INTO isuumo.schema_version (id, schema_version) VALUES (1, 7);\n", 7, false},
+		{"multi-digit version", "INSERT INTO isuumo.schema_version (id, schema_version) VALUES (1, 123);", 123, false},
+		{"whitespace variants", "INSERT  INTO isuumo.schema_version\n  ( id,schema_version )\nVALUES\t( 1 ,  3 ) ;", 3, false},
+		{"lower case without database", "insert into schema_version (id, schema_version) values (1, 4);", 4, false},
+		{"does not read the id", "INSERT INTO isuumo.schema_version (id, schema_version) VALUES (1, 9);", 9, false},
+		{"missing row", "CREATE TABLE isuumo.schema_version (id INTEGER);", 0, true},
+		{"other id", "INSERT INTO isuumo.schema_version (id, schema_version) VALUES (2, 5);", 0, true},
+		{"multiple values", "INSERT INTO isuumo.schema_version (id, schema_version) VALUES (1, 5), (2, 6);", 0, true},
+		{"multiple inserts", "INSERT INTO isuumo.schema_version (id, schema_version) VALUES (1, 5);\nINSERT INTO isuumo.schema_version (id, schema_version) VALUES (1, 6);", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSchemaVersion([]byte(tt.schema))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseSchemaVersion() = %d, want error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("parseSchemaVersion() = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareDBVersions(t *testing.T) {
+	seeded := DBVersion{SchemaVersion: 2, ChairDataVersion: "c1", EstateDataVersion: "e1"}
+	tests := []struct {
+		name          string
+		chair, estate DBVersion
+		want          DBVersion
+		wantErr       bool
+	}{
+		{"match", seeded, seeded, DBVersion{SchemaVersion: 2}, false},
+		{"match with seed hashes", seeded, seeded, seeded, false},
+		{"init.sh seeded", DBVersion{SchemaVersion: 2}, DBVersion{SchemaVersion: 2}, DBVersion{SchemaVersion: 2}, false},
+		{"chair db schema differs", DBVersion{SchemaVersion: 1, ChairDataVersion: "c1", EstateDataVersion: "e1"}, seeded, DBVersion{SchemaVersion: 2}, true},
+		{"estate db schema differs", seeded, DBVersion{SchemaVersion: 3, ChairDataVersion: "c1", EstateDataVersion: "e1"}, DBVersion{SchemaVersion: 2}, true},
+		{"chair data differs between dbs", seeded, DBVersion{SchemaVersion: 2, ChairDataVersion: "c2", EstateDataVersion: "e1"}, DBVersion{SchemaVersion: 2}, true},
+		{"estate data differs between dbs", seeded, DBVersion{SchemaVersion: 2, ChairDataVersion: "c1", EstateDataVersion: "e2"}, DBVersion{SchemaVersion: 2}, true},
+		{"one db not seeded", seeded, DBVersion{SchemaVersion: 2}, DBVersion{SchemaVersion: 2}, true},
+		{"chair seed hash differs from files", seeded, seeded, DBVersion{SchemaVersion: 2, ChairDataVersion: "c2", EstateDataVersion: "e1"}, true},
+		{"estate seed hash differs from files", seeded, seeded, DBVersion{SchemaVersion: 2, ChairDataVersion: "c1", EstateDataVersion: "e2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := compareDBVersions(tt.chair, tt.estate, tt.want)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("compareDBVersions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	webhookChairAdded   = "chair.added"
+	webhookChairSoldOut = "chair.sold_out"
+	// webhookChairRestocked 在庫切れになった椅子に在庫が戻った。仮押さえの期限切れでも送る
+	webhookChairRestocked = "chair.restocked"
+	webhookEstateAdded    = "estate.added"
+)
+
+var webhookEventTypes = []string{webhookChairAdded, webhookChairSoldOut, webhookChairRestocked, webhookEstateAdded}
+
+// WebhookSubscription カタログの変更を通知する先。
+// 椅子と物件のどちらのイベントも扱うので、購読と配送履歴は chairDb にまとめて置く
+type WebhookSubscription struct {
+	ID         int64     `db:"id" json:"id"`
+	URL        string    `db:"url" json:"url"`
+	Secret     string    `db:"secret" json:"secret,omitempty"`
+	EventTypes string    `db:"event_types" json:"-"`
+	Active     bool      `db:"active" json:"active"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+}
+
+// MarshalJSON レスポンスでは event_types を配列で返す
+func (s WebhookSubscription) MarshalJSON() ([]byte, error) {
+	type subscription WebhookSubscription
+	return json.Marshal(struct {
+		subscription
+		EventTypes []string `json:"eventTypes"`
+	}{subscription(s), strings.Split(s.EventTypes, ",")})
+}
+
+// subscribes s が eventType を購読しているかを返す
+func (s WebhookSubscription) subscribes(eventType string) bool {
+	return contains(strings.Split(s.EventTypes, ","), eventType)
+}
+
+// WebhookDelivery 購読先への配送履歴
+type WebhookDelivery struct {
+	ID             int64      `db:"id" json:"id"`
+	SubscriptionID int64      `db:"subscription_id" json:"subscriptionId"`
+	EventType      string     `db:"event_type" json:"eventType"`
+	Payload        string     `db:"payload" json:"payload"`
+	Status         string     `db:"status" json:"status"`
+	Attempts       int        `db:"attempts" json:"attempts"`
+	ResponseStatus int        `db:"response_status" json:"responseStatus"`
+	LastError      string     `db:"last_error" json:"lastError"`
+	NextAttemptAt  time.Time  `db:"next_attempt_at" json:"nextAttemptAt"`
+	CreatedAt      time.Time  `db:"created_at" json:"createdAt"`
+	DeliveredAt    *time.Time `db:"delivered_at" json:"deliveredAt"`
+}
+
+type WebhookDeliveryListResponse struct {
+	Count      int64             `json:"count"`
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+// webhookJobs 配送履歴を作る処理の待ち行列。購入や入稿のハンドラを chairDb への書き込みで待たせない
+var webhookJobs = newJobQueue("webhook")
+
+// publishWebhookEvents payloads をそれぞれ eventType のイベントとして配送履歴を作る処理を積む。
+// payload は積んだ時点の内容で送るように、ここで JSON にしておく
+func publishWebhookEvents[T any](eventType string, payloads []T) {
+	if len(payloads) == 0 {
+		return
+	}
+	encoded := make([]string, 0, len(payloads))
+	for _, payload := range payloads {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			log.Errorf("failed to marshal webhook payload : %v", err)
+			continue
+		}
+		encoded = append(encoded, string(b))
+	}
+	webhookJobs.push(func() error {
+		return insertWebhookDeliveries(eventType, encoded)
+	})
+}
+
+// publishWebhookEvent 1件のイベントの配送履歴を作る処理を積む
+func publishWebhookEvent(eventType string, payload interface{}) {
+	publishWebhookEvents(eventType, []interface{}{payload})
+}
+
+// insertWebhookDeliveries payloads の各イベントについて、購読している全ての購読先への配送履歴を作る。
+// 購読先は1回だけ読み、配送履歴は importBatchSize 件ずつまとめて1つのトランザクションで挿入するので、失敗しても再試行してよい
+func insertWebhookDeliveries(eventType string, payloads []string) error {
+	var subscriptions []WebhookSubscription
+	if err := chairDb.Select(&subscriptions, "SELECT * FROM webhook_subscription WHERE active = TRUE"); err != nil {
+		return err
+	}
+	targets := subscriptions[:0]
+	for _, s := range subscriptions {
+		if s.subscribes(eventType) {
+			targets = append(targets, s)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	deliveries := make([]WebhookDelivery, 0, len(payloads)*len(targets))
+	for _, payload := range payloads {
+		for _, s := range targets {
+			deliveries = append(deliveries, WebhookDelivery{SubscriptionID: s.ID, EventType: eventType, Payload: payload, Status: outboxPending, NextAttemptAt: now})
+		}
+	}
+
+	tx, err := chairDb.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := "INSERT INTO webhook_delivery (subscription_id, event_type, payload, status, next_attempt_at)" +
+		" VALUES (:subscription_id, :event_type, :payload, :status, :next_attempt_at)"
+	for start := 0; start < len(deliveries); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(deliveries) {
+			end = len(deliveries)
+		}
+		if _, err := tx.NamedExec(query, deliveries[start:end]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// webhookMessage 購読先に POST する本文
+type webhookMessage struct {
+	DeliveryID int64           `json:"deliveryId"`
+	EventType  string          `json:"eventType"`
+	Payload    json.RawMessage `json:"payload"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+// signWebhook 本文の HMAC-SHA256 を secret で計算する
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// deliverWebhook 1件の配送を行い、購読先の応答ステータスを返す
+func deliverWebhook(s WebhookSubscription, d WebhookDelivery) (int, error) {
+	body, err := json.Marshal(webhookMessage{
+		DeliveryID: d.ID,
+		EventType:  d.EventType,
+		Payload:    json.RawMessage(d.Payload),
+		CreatedAt:  d.CreatedAt,
+	})
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Isuumo-Event", d.EventType)
+	req.Header.Set("X-Isuumo-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("X-Isuumo-Signature", signWebhook(s.Secret, body))
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || 300 <= res.StatusCode {
+		return res.StatusCode, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// dispatchWebhookDeliveries 配送期限の来た配送を行い、失敗したものは outbox と同じ間隔で再送する
+func dispatchWebhookDeliveries() error {
+	var deliveries []WebhookDelivery
+	query := "SELECT d.* FROM webhook_delivery d JOIN webhook_subscription s ON s.id = d.subscription_id" +
+		" WHERE d.status = ? AND d.next_attempt_at <= ? AND s.active = TRUE ORDER BY d.id ASC LIMIT ?"
+	if err := chairDb.Select(&deliveries, query, outboxPending, time.Now(), outboxBatchSize); err != nil {
+		return err
+	}
+
+	subscriptions := map[int64]WebhookSubscription{}
+	for _, d := range deliveries {
+		s, ok := subscriptions[d.SubscriptionID]
+		if !ok {
+			if err := chairDb.Get(&s, "SELECT * FROM webhook_subscription WHERE id = ?", d.SubscriptionID); err != nil {
+				if err == sql.ErrNoRows {
+					continue
+				}
+				return err
+			}
+			subscriptions[d.SubscriptionID] = s
+		}
+
+		status, err := deliverWebhook(s, d)
+		if err == nil {
+			if _, err := chairDb.Exec("UPDATE webhook_delivery SET status = ?, attempts = attempts + 1, response_status = ?, last_error = '', delivered_at = ? WHERE id = ?",
+				outboxDelivered, status, time.Now(), d.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		attempts := d.Attempts + 1
+		next := outboxPending
+		if attempts >= outboxMaxAttempts {
+			next = outboxFailed
+		}
+		lastError := err.Error()
+		if len(lastError) > 1024 {
+			lastError = lastError[:1024]
+		}
+		if _, err := chairDb.Exec("UPDATE webhook_delivery SET status = ?, attempts = ?, response_status = ?, last_error = ?, next_attempt_at = ? WHERE id = ?",
+			next, attempts, status, lastError, time.Now().Add(outboxBackoff(attempts)), d.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runWebhookDispatcher(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := dispatchWebhookDeliveries(); err != nil {
+			log.Errorf("failed to dispatch webhook deliveries : %v", err)
+		}
+	}
+}
+
+type webhookSubscriptionRequest struct {
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	EventTypes []string `json:"eventTypes"`
+	Active     *bool    `json:"active"`
+}
+
+// validate リクエストを検証し、購読するイベントをカンマ区切りにして返す
+func (r webhookSubscriptionRequest) validate() (string, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid url: %v", r.URL)
+	}
+	if len(r.EventTypes) == 0 {
+		return "", fmt.Errorf("eventTypes is empty")
+	}
+	for _, t := range r.EventTypes {
+		if !contains(webhookEventTypes, t) {
+			return "", fmt.Errorf("unknown event type: %v", t)
+		}
+	}
+	return strings.Join(r.EventTypes, ","), nil
+}
+
+func postWebhookSubscription(c echo.Context) error {
+	var req webhookSubscriptionRequest
+	if err := c.Bind(&req); err != nil {
+		c.Echo().Logger.Infof("post webhook subscription failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	eventTypes, err := req.validate()
+	if err != nil {
+		c.Echo().Logger.Infof("post webhook subscription failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	s := WebhookSubscription{URL: req.URL, Secret: req.Secret, EventTypes: eventTypes, Active: true}
+	if req.Active != nil {
+		s.Active = *req.Active
+	}
+	if s.Secret == "" {
+		// 署名の検証に必要なので、指定がなければ作って作成時のレスポンスでだけ返す
+		if s.Secret, err = newRandomToken(); err != nil {
+			c.Echo().Logger.Errorf("failed to generate webhook secret : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	res, err := chairDb.Exec("INSERT INTO webhook_subscription (url, secret, event_types, active) VALUES (?, ?, ?, ?)", s.URL, s.Secret, s.EventTypes, s.Active)
+	if err != nil {
+		c.Logger().Errorf("postWebhookSubscription DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("postWebhookSubscription DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := chairDb.Get(&s, "SELECT * FROM webhook_subscription WHERE id = ?", id); err != nil {
+		c.Logger().Errorf("postWebhookSubscription DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, s)
+}
+
+func getWebhookSubscriptions(c echo.Context) error {
+	subscriptions := []WebhookSubscription{}
+	if err := chairDb.Select(&subscriptions, "SELECT * FROM webhook_subscription ORDER BY id ASC"); err != nil {
+		c.Logger().Errorf("getWebhookSubscriptions DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+	return c.JSON(http.StatusOK, subscriptions)
+}
+
+// findWebhookSubscription パスパラメータの id の購読を読む。見つからなければレスポンスを書いて ok = false を返す
+func findWebhookSubscription(c echo.Context) (s WebhookSubscription, ok bool, err error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return s, false, c.NoContent(http.StatusBadRequest)
+	}
+	if err := chairDb.Get(&s, "SELECT * FROM webhook_subscription WHERE id = ?", id); err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("webhook subscription id %v not found", id)
+			return s, false, c.NoContent(http.StatusNotFound)
+		}
+		c.Logger().Errorf("webhook subscription DB execution error : %v", err)
+		return s, false, c.NoContent(http.StatusInternalServerError)
+	}
+	return s, true, nil
+}
+
+func getWebhookSubscription(c echo.Context) error {
+	s, ok, err := findWebhookSubscription(c)
+	if !ok {
+		return err
+	}
+	s.Secret = ""
+	return c.JSON(http.StatusOK, s)
+}
+
+func putWebhookSubscription(c echo.Context) error {
+	s, ok, err := findWebhookSubscription(c)
+	if !ok {
+		return err
+	}
+
+	var req webhookSubscriptionRequest
+	if err := c.Bind(&req); err != nil {
+		c.Echo().Logger.Infof("put webhook subscription failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	eventTypes, err := req.validate()
+	if err != nil {
+		c.Echo().Logger.Infof("put webhook subscription failed : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	s.URL = req.URL
+	s.EventTypes = eventTypes
+	if req.Active != nil {
+		s.Active = *req.Active
+	}
+	// secret は指定された場合だけ差し替える
+	if req.Secret != "" {
+		s.Secret = req.Secret
+	}
+	if _, err := chairDb.Exec("UPDATE webhook_subscription SET url = ?, secret = ?, event_types = ?, active = ? WHERE id = ?", s.URL, s.Secret, s.EventTypes, s.Active, s.ID); err != nil {
+		c.Logger().Errorf("putWebhookSubscription DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	s.Secret = ""
+	return c.JSON(http.StatusOK, s)
+}
+
+func deleteWebhookSubscription(c echo.Context) error {
+	s, ok, err := findWebhookSubscription(c)
+	if !ok {
+		return err
+	}
+
+	tx, err := chairDb.Beginx()
+	if err != nil {
+		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM webhook_subscription WHERE id = ?", s.ID); err != nil {
+		c.Logger().Errorf("deleteWebhookSubscription DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// 配送履歴は残し、未配送のものは送り先がなくなったので失敗にしておく
+	if _, err := tx.Exec("UPDATE webhook_delivery SET status = ?, last_error = 'subscription deleted' WHERE subscription_id = ? AND status = ?", outboxFailed, s.ID, outboxPending); err != nil {
+		c.Logger().Errorf("deleteWebhookSubscription DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := tx.Commit(); err != nil {
+		c.Echo().Logger.Errorf("transaction commit error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func getWebhookDeliveries(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	page, perPage, err := parsePagination(c)
+	if err != nil {
+		c.Logger().Infof("Invalid format pagination parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	var res WebhookDeliveryListResponse
+	if err := chairDb.Get(&res.Count, "SELECT COUNT(*) FROM webhook_delivery WHERE subscription_id = ?", id); err != nil {
+		c.Logger().Errorf("getWebhookDeliveries DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res.Deliveries = []WebhookDelivery{}
+	query := "SELECT * FROM webhook_delivery WHERE subscription_id = ? ORDER BY id DESC LIMIT ? OFFSET ?"
+	if err := chairDb.Select(&res.Deliveries, query, id, perPage, page*perPage); err != nil {
+		c.Logger().Errorf("getWebhookDeliveries DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
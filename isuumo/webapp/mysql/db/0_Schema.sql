@@ -2,7 +2,30 @@ DROP DATABASE IF EXISTS isuumo;
 CREATE DATABASE isuumo;
 
 DROP TABLE IF EXISTS isuumo.estate;
+DROP TABLE IF EXISTS isuumo.estate_document_request;
 DROP TABLE IF EXISTS isuumo.chair;
+DROP TABLE IF EXISTS isuumo.chair_order;
+DROP TABLE IF EXISTS isuumo.chair_reservation;
+DROP TABLE IF EXISTS isuumo.outbox_event;
+DROP TABLE IF EXISTS isuumo.webhook_subscription;
+DROP TABLE IF EXISTS isuumo.webhook_delivery;
+DROP TABLE IF EXISTS isuumo.saved_search;
+DROP TABLE IF EXISTS isuumo.saved_search_match;
+DROP TABLE IF EXISTS isuumo.schema_version;
+
+-- schema_version 椅子と物件の DB が同じスキーマと同じ初期データで動いているかを確かめるための1行だけのテーブル。
+-- schema_version はこのファイルを変えたら下の INSERT で上げる。アプリケーションは起動時にこの INSERT から前提とする版を読む。
+-- chair_data_version, estate_data_version は /initialize が読み込んだ椅子と物件の初期データのハッシュで、
+-- 両方の DB に両方を入れる。init.sh で読み込んだ場合は空のまま
+CREATE TABLE isuumo.schema_version
+(
+    id                  INTEGER         NOT NULL PRIMARY KEY,
+    schema_version      INTEGER         NOT NULL,
+    chair_data_version  VARCHAR(64)     NOT NULL DEFAULT '',
+    estate_data_version VARCHAR(64)     NOT NULL DEFAULT '',
+    updated_at          DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
+);
+INSERT INTO isuumo.schema_version (id, schema_version) VALUES (1, 2);
 
 CREATE TABLE isuumo.estate
 (
@@ -17,9 +40,21 @@ CREATE TABLE isuumo.estate
     door_height INTEGER             NOT NULL,
     door_width  INTEGER             NOT NULL,
     features    VARCHAR(64)         NOT NULL,
+    features_mask BIGINT UNSIGNED   NOT NULL DEFAULT 0,
     popularity  INTEGER             NOT NULL
 );
 
+CREATE TABLE isuumo.estate_document_request
+(
+    id              BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    estate_id       INTEGER         NOT NULL,
+    email           VARCHAR(256)    NOT NULL,
+    message         TEXT            NOT NULL,
+    created_at      DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    acknowledged_at DATETIME(6)     NULL,
+    KEY `estate_id_id` (`estate_id`, `id`)
+);
+
 CREATE TABLE isuumo.chair
 (
     id          INTEGER         NOT NULL PRIMARY KEY,
@@ -32,29 +67,102 @@ CREATE TABLE isuumo.chair
     depth       INTEGER         NOT NULL,
     color       VARCHAR(64)     NOT NULL,
     features    VARCHAR(64)     NOT NULL,
+    features_mask BIGINT UNSIGNED NOT NULL DEFAULT 0,
     kind        VARCHAR(64)     NOT NULL,
     popularity  INTEGER         NOT NULL,
-    stock       INTEGER         NOT NULL
+    stock       INTEGER         NOT NULL,
+    stock_order_id       BIGINT NOT NULL DEFAULT 0,
+    stock_reservation_id BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE isuumo.chair_order
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    chair_id    INTEGER         NOT NULL,
+    email       VARCHAR(256)    NOT NULL,
+    price       INTEGER         NOT NULL,
+    quantity    INTEGER         NOT NULL,
+    created_at  DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    reservation_id BIGINT       NULL,
+    KEY `email_id` (`email`, `id`),
+    KEY `chair_id_id` (`chair_id`, `id`)
+);
+
+CREATE TABLE isuumo.chair_reservation
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    token       VARCHAR(64)     NOT NULL,
+    chair_id    INTEGER         NOT NULL,
+    email       VARCHAR(256)    NOT NULL,
+    quantity    INTEGER         NOT NULL,
+    expires_at  DATETIME(6)     NOT NULL,
+    status      VARCHAR(16)     NOT NULL DEFAULT 'held',
+    UNIQUE KEY `token` (`token`),
+    KEY `status_expires_at` (`status`, `expires_at`),
+    KEY `chair_id_id` (`chair_id`, `id`)
+);
+
+CREATE TABLE isuumo.outbox_event
+(
+    id              BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    event_type      VARCHAR(64)     NOT NULL,
+    payload         TEXT            NOT NULL,
+    status          VARCHAR(16)     NOT NULL DEFAULT 'pending',
+    attempts        INTEGER         NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME(6)     NOT NULL,
+    last_error      VARCHAR(1024)   NOT NULL DEFAULT '',
+    created_at      DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    KEY `status_next_attempt_at` (`status`, `next_attempt_at`)
+);
+
+CREATE TABLE isuumo.webhook_subscription
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    url         VARCHAR(1024)   NOT NULL,
+    secret      VARCHAR(256)    NOT NULL,
+    event_types VARCHAR(256)    NOT NULL,
+    active      BOOLEAN         NOT NULL DEFAULT TRUE,
+    created_at  DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+
+CREATE TABLE isuumo.webhook_delivery
+(
+    id              BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    subscription_id BIGINT          NOT NULL,
+    event_type      VARCHAR(64)     NOT NULL,
+    payload         TEXT            NOT NULL,
+    status          VARCHAR(16)     NOT NULL DEFAULT 'pending',
+    attempts        INTEGER         NOT NULL DEFAULT 0,
+    response_status INTEGER         NOT NULL DEFAULT 0,
+    last_error      VARCHAR(1024)   NOT NULL DEFAULT '',
+    next_attempt_at DATETIME(6)     NOT NULL,
+    created_at      DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    delivered_at    DATETIME(6)     NULL,
+    KEY `status_next_attempt_at` (`status`, `next_attempt_at`),
+    KEY `subscription_id_id` (`subscription_id`, `id`)
+);
+
+CREATE TABLE isuumo.saved_search
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    email       VARCHAR(256)    NOT NULL,
+    target      VARCHAR(16)     NOT NULL,
+    query       TEXT            NOT NULL,
+    created_at  DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    KEY `email_id` (`email`, `id`),
+    KEY `target` (`target`)
+);
+
+CREATE TABLE isuumo.saved_search_match
+(
+    id              BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    saved_search_id BIGINT          NOT NULL,
+    item_id         INTEGER         NOT NULL,
+    created_at      DATETIME(6)     NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    UNIQUE KEY `saved_search_id_item_id` (`saved_search_id`, `item_id`),
+    KEY `saved_search_id_id` (`saved_search_id`, `id`)
 );
 
-ALTER TABLE isuumo.estate ADD COLUMN `rent_range` INTEGER AS (CASE
-    WHEN                    rent <  50000 THEN 0
-    WHEN  50000 <= rent AND rent < 100000 THEN 1
-    WHEN 100000 <= rent AND rent < 150000 THEN 2
-    WHEN 150000 <= rent THEN 3
-END) STORED;
-ALTER TABLE isuumo.estate ADD COLUMN `door_width_range` INTEGER AS (CASE
-    WHEN                    door_width <  80 THEN 0
-    WHEN  80 <= door_width AND door_width < 110 THEN 1
-    WHEN 110 <= door_width AND door_width < 150 THEN 2
-    WHEN 150 <= door_width THEN 3
-END) STORED;
-ALTER TABLE isuumo.estate ADD COLUMN `door_height_range` INTEGER AS (CASE
-    WHEN                    door_height <  80 THEN 0
-    WHEN  80 <= door_height AND door_height < 110 THEN 1
-    WHEN 110 <= door_height AND door_height < 150 THEN 2
-    WHEN 150 <= door_height THEN 3
-END) STORED;
 ALTER TABLE isuumo.estate ADD COLUMN `popularity_m` INTEGER AS (-`popularity`) STORED;
 ALTER TABLE isuumo.estate ADD KEY `popularity_m_id` (`popularity_m`, `id`);
 -- explain SELECT * FROM estate WHERE rent >= 100000 AND rent < 150000 ORDER BY popularity_m ASC, id ASC LIMIT 25 OFFSET 75;
@@ -63,95 +171,28 @@ ALTER TABLE isuumo.estate ADD KEY `popularity_m_id` (`popularity_m`, `id`);
 ALTER TABLE isuumo.estate ADD KEY `rent_id` (`rent`, `id`);
 -- EXPLAIN SELECT * FROM estate ORDER BY rent ASC, id ASC LIMIT 20;
 
-ALTER TABLE isuumo.estate ADD INDEX `door_height_door_width_rent_range_popularity_m_id` (`door_height_range`, `door_width_range`, `rent_range`, `popularity_m`, `id`);
-ALTER TABLE isuumo.estate ADD INDEX `door_height_rent_range_popularity_m_id` (`door_height_range`, `rent_range`, `popularity_m`, `id`);
-ALTER TABLE isuumo.estate ADD INDEX `door_width_rent_range_popularity_m_id` (`door_width_range`, `rent_range`, `popularity_m`, `id`);
-ALTER TABLE isuumo.estate ADD INDEX `rent_range_popularity_m_id` (`rent_range`, `popularity_m`, `id`);
+ALTER TABLE isuumo.estate ADD KEY `door_height_id` (`door_height`, `id`);
+ALTER TABLE isuumo.estate ADD KEY `door_width_id` (`door_width`, `id`);
 --  EXPLAIN SELECT COUNT(*) FROM estate WHERE door_height >= 110 AND door_height < 150;
 --  EXPLAIN SELECT COUNT(*) FROM estate WHERE door_width >= 80 AND door_width < 110\G;
 -- EXPLAIN SELECT COUNT(*) FROM estate WHERE rent >= 100000 AND rent < 150000;
+-- sort=rent_desc, door_width_desc, door_height_desc は (列, id) のインデックスを逆順に読む
+-- EXPLAIN SELECT * FROM estate WHERE rent >= 100000 AND rent < 150000 ORDER BY rent DESC, id DESC LIMIT 25;
+-- EXPLAIN SELECT * FROM estate WHERE door_width >= 80 AND door_width < 110 ORDER BY door_width DESC, id DESC LIMIT 25;
 
 
 
-ALTER TABLE isuumo.chair ADD COLUMN `width_range` INTEGER AS (CASE
-    WHEN                  width <  80 THEN 0
-    WHEN  80 <= width AND width < 110 THEN 1
-    WHEN 110 <= width AND width < 150 THEN 2
-    WHEN 150 <= width THEN 3
-END) STORED;
-ALTER TABLE isuumo.chair ADD COLUMN `height_range` INTEGER AS (CASE
-    WHEN                   height <  80 THEN 0
-    WHEN  80 <= height AND height < 110 THEN 1
-    WHEN 110 <= height AND height < 150 THEN 2
-    WHEN 150 <= height THEN 3
-END) STORED;
-ALTER TABLE isuumo.chair ADD COLUMN `depth_range` INTEGER AS (CASE
-    WHEN                  depth <  80 THEN 0
-    WHEN  80 <= depth AND depth < 110 THEN 1
-    WHEN 110 <= depth AND depth < 150 THEN 2
-    WHEN 150 <= depth THEN 3
-END) STORED;
-ALTER TABLE isuumo.chair ADD COLUMN `price_range` INTEGER AS (CASE
-    WHEN                   price <  3000 THEN 0
-    WHEN  3000 <= price AND price <  6000 THEN 1
-    WHEN  6000 <= price AND price <  9000 THEN 2
-    WHEN  9000 <= price AND price < 12000 THEN 3
-    WHEN 12000 <= price AND price < 15000 THEN 4
-    WHEN 15000 <= price THEN 5
-END) STORED;
-
-
 ALTER TABLE isuumo.chair ADD COLUMN `popularity_m` INTEGER AS (-`popularity`) STORED;
 ALTER TABLE isuumo.chair ADD COLUMN `in_stock` BOOLEAN AS (`stock` != 0) STORED;
 
 
-ALTER TABLE isuumo.chair ADD KEY `in_stock_pwhd_range_pi` (`in_stock`, `price_range`, `width_range`, `height_range`, `depth_range`, `popularity_m`, `id`);
-ALTER TABLE isuumo.chair ADD KEY `in_stock_pwh_range_pi` (`in_stock`, `price_range`, `width_range`, `height_range`, `popularity_m`, `id`);
--- ALTER TABLE isuumo.chair ADD KEY `in_stock_pwd_range_pi` (`in_stock`, `price_range`, `width_range`, `depth_range`, `popularity_m`, `id`);
--- ALTER TABLE isuumo.chair ADD KEY `in_stock_pw_range_pi` (`in_stock`, `price_range`, `width_range`, `popularity_m`, `id`);
--- ALTER TABLE isuumo.chair ADD KEY `in_stock_phd_range_pi` (`in_stock`, `price_range`, `height_range`, `depth_range`, `popularity_m`, `id`);
-ALTER TABLE isuumo.chair ADD KEY `in_stock_ph_range_pi` (`in_stock`, `price_range`, `height_range`, `popularity_m`, `id`);
--- ALTER TABLE isuumo.chair ADD KEY `in_stock_pd_range_pi` (`in_stock`, `price_range`, `depth_range`, `popularity_m`, `id`);
--- ALTER TABLE isuumo.chair ADD KEY `in_stock_p_range_pi` (`in_stock`, `price_range`, `popularity_m`, `id`);
--- ALTER TABLE isuumo.chair ADD KEY `in_stock_pwhd_range_k_pi` (`in_stock`, `price_range`, `width_range`, `height_range`, `depth_range`, `kind`, `popularity_m`, `id`);
-ALTER TABLE isuumo.chair ADD KEY `in_stock_pwh_range_k_pi` (`in_stock`, `price_range`, `width_range`, `height_range`, `kind`, `popularity_m`, `id`);
-ALTER TABLE isuumo.chair ADD KEY `in_stock_pwd_range_k_pi` (`in_stock`, `price_range`, `width_range`, `depth_range`, `kind`, `popularity_m`, `id`);
--- ALTER TABLE isuumo.chair ADD KEY `in_stock_pw_range_k_pi` (`in_stock`, `price_range`, `width_range`, `kind`, `popularity_m`, `id`);
-ALTER TABLE isuumo.chair ADD KEY `in_stock_phd_range_k_pi` (`in_stock`, `price_range`, `height_range`, `depth_range`, `kind`, `popularity_m`, `id`);
-ALTER TABLE isuumo.chair ADD KEY `in_stock_ph_range_k_pi` (`in_stock`, `price_range`, `height_range`, `kind`, `popularity_m`, `id`);
--- ALTER TABLE isuumo.chair ADD KEY `in_stock_pd_range_k_pi` (`in_stock`, `price_range`, `depth_range`, `kind`, `popularity_m`, `id`);
--- ALTER TABLE isuumo.chair ADD KEY `in_stock_p_range_k_pi` (`in_stock`, `price_range`, `kind`, `popularity_m`, `id`);
-
-
-ALTER TABLE isuumo.chair ADD KEY `in_stock_k_pi` (`in_stock`, `kind`, `popularity_m`, `id`);
-
-
-ALTER TABLE isuumo.chair ADD KEY `in_stock_height` (`in_stock`, `height`);
--- EXPLAIN SELECT COUNT(*) FROM chair WHERE height >= 80 AND height < 110 AND `in_stock` = 1;
-
-ALTER TABLE isuumo.chair ADD KEY `in_stock_kind` (`in_stock`, `kind`);
--- EXPLAIN SELECT COUNT(*) FROM chair WHERE kind = 'ゲーミングチェア' AND `in_stock` = 1;
-
 ALTER TABLE isuumo.chair ADD KEY `in_stock_price_id` (`in_stock`, `price`, `id`);
 -- EXPLAIN SELECT * FROM chair WHERE `in_stock` = 1 ORDER BY price, id LIMIT 20;
 
 ALTER TABLE isuumo.chair ADD KEY `in_stock_popularity_m_id` (`in_stock`, `popularity_m`, `id`);
--- EXPLAIN SELECT * FROM chair WHERE width >= 110 AND width < 150 AND `in_stock` = 1 ORDER BY popularity_m ASC, id ASC LIMIT 25 OFFSET 0;
-
-ALTER TABLE isuumo.chair ADD INDEX `color_in_stock_popularity_m_id` (`color`, `in_stock`, `popularity_m`, `id`);
---  explain SELECT * FROM chair WHERE color = 'ネイビー' AND `in_stock` = 1 ORDER BY popularity DESC, id ASC LIMIT 25 OFFSET 0;
-
-ALTER TABLE isuumo.chair ADD INDEX `in_stock_width` (`in_stock`, `width`);
---  EXPLAIN SELECT COUNT(*) FROM chair WHERE width >= 80 AND width < 110 AND `in_stock` = 1;
-ALTER TABLE isuumo.chair ADD INDEX `in_stock_depth` (`in_stock`, `depth`);
---  EXPLAIN SELECT COUNT(*) FROM chair WHERE depth >= 110 AND depth < 150 AND `in_stock` = 1;
-
-
-
+-- EXPLAIN SELECT * FROM chair WHERE `in_stock` = 1 ORDER BY popularity_m ASC, id ASC;
 
-ALTER TABLE isuumo.estate ADD COLUMN `point` GEOMETRY GENERATED ALWAYS AS (Point(latitude, longitude)) STORED;
--- Bug of MySQL 5.7.20 https://bugs.mysql.com/bug.php?id=88972
-ALTER TABLE isuumo.estate MODIFY COLUMN `point` GEOMETRY AS (POINT(latitude, longitude)) STORED NOT NULL;
-ALTER TABLE isuumo.estate ADD SPATIAL INDEX `point` (`point`);
--- EXPLAIN SELECT * FROM estate WHERE ST_Contains(ST_PolygonFromText('POLYGON((-71.1776585052917 42.3902909739571,-71.1776820268866 42.3903701743239,
--- -71.1776063012595 42.3903825660754,-71.1775826583081 42.3903033653531,-71.1776585052917 42.3902909739571))'), point) ORDER BY popularity_m ASC, id ASC LIMIT 50;
+-- q パラメータのキーワード検索。日本語を分かち書きせずに引けるよう ngram パーサを使う
+ALTER TABLE isuumo.chair ADD FULLTEXT KEY `name_description` (`name`, `description`) WITH PARSER ngram;
+ALTER TABLE isuumo.estate ADD FULLTEXT KEY `name_description` (`name`, `description`) WITH PARSER ngram;
+-- EXPLAIN SELECT id FROM chair WHERE MATCH(name, description) AGAINST('+"椅子"' IN BOOLEAN MODE);